@@ -0,0 +1,111 @@
+package fog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// archAliases maps Go and OCI architecture names to the names used by QEMU and image manifests.
+var archAliases = map[string]string{
+	"amd64":   "x86_64",
+	"x86-64":  "x86_64",
+	"arm64":   "aarch64",
+	"riscv64": "riscv64",
+}
+
+// normalizeArch returns the canonical name of an architecture.
+func normalizeArch(arch string) string {
+	if a, ok := archAliases[arch]; ok {
+		return a
+	}
+
+	return arch
+}
+
+// ociArch returns the OCI platform name of an architecture.
+func ociArch(arch string) string {
+	for k, v := range archAliases {
+		if v == arch && k != "x86-64" {
+			return k
+		}
+	}
+
+	return arch
+}
+
+// HostArch returns the architecture of the host.
+func HostArch() string {
+	return normalizeArch(runtime.GOARCH)
+}
+
+// archProfile describes how to run machines of an architecture with QEMU.
+type archProfile struct {
+	// binary is the QEMU system emulator
+	binary string
+	// machine is the machine type, or empty for QEMU's default
+	machine string
+	// tcgCpu is the CPU model used when emulating the architecture
+	tcgCpu string
+	// firmware lists candidate paths of the firmware to boot with
+	firmware []string
+	// kernel lists candidate paths of a bootloader loaded as the kernel
+	kernel []string
+	// virtio uses a virtio network device instead of the legacy NIC
+	virtio bool
+}
+
+// archProfiles holds the supported guest architectures.
+var archProfiles = map[string]*archProfile{
+	"x86_64": {
+		binary: "qemu-system-x86_64",
+		tcgCpu: "max",
+	},
+	"aarch64": {
+		binary:  "qemu-system-aarch64",
+		machine: "virt",
+		tcgCpu:  "max",
+		firmware: []string{
+			"/usr/share/qemu-efi-aarch64/QEMU_EFI.fd",
+			"/usr/share/AAVMF/AAVMF_CODE.fd",
+			"/usr/share/edk2/aarch64/QEMU_EFI.fd",
+			"/usr/share/qemu/edk2-aarch64-code.fd",
+			"/opt/homebrew/share/qemu/edk2-aarch64-code.fd",
+			"/usr/local/share/qemu/edk2-aarch64-code.fd",
+		},
+		virtio: true,
+	},
+	"riscv64": {
+		binary:  "qemu-system-riscv64",
+		machine: "virt",
+		tcgCpu:  "rv64",
+		kernel: []string{
+			"/usr/lib/u-boot/qemu-riscv64_smode/uboot.elf",
+			"/usr/share/u-boot/qemu-riscv64_smode/uboot.elf",
+		},
+		virtio: true,
+	},
+}
+
+// profileForArch returns the QEMU profile of an architecture.
+func profileForArch(arch string) (*archProfile, error) {
+	p, ok := archProfiles[normalizeArch(arch)]
+
+	if !ok {
+		return nil, fmt.Errorf("unsupported architecture '%s'", arch)
+	}
+
+	return p, nil
+}
+
+// findFile returns the first existing file of a list of candidates.
+func findFile(candidates []string) (string, error) {
+	for _, c := range candidates {
+		if _, err := os.Stat(c); err == nil {
+			return c, nil
+		}
+	}
+
+	return "", errors.New("none of the candidate files exist")
+}
@@ -0,0 +1,348 @@
+package fog
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	// defaultBuildTimeout limits how long provisioning a build machine may take
+	defaultBuildTimeout = 30 * time.Minute
+	// buildShutdownTimeout limits how long a build machine may take to power off
+	buildShutdownTimeout = 2 * time.Minute
+)
+
+// cloudInitFinished matches the final message cloud-init writes to the console.
+var cloudInitFinished = regexp.MustCompile(`Cloud-init v\. \S+ finished at`)
+
+// buildCleanUnit is a systemd unit which resets cloud-init when the build machine shuts down,
+// so the image is provisioned again on its first boot.
+const buildCleanUnit = `[Unit]
+Description=Reset cloud-init for fog image build
+DefaultDependencies=no
+Before=shutdown.target
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=/bin/true
+ExecStop=/usr/bin/cloud-init clean --logs --seed
+ExecStopPost=/bin/rm -f /etc/systemd/system/fog-build-clean.service
+`
+
+// ImageBuild describes how to build a derived image from a base image.
+type ImageBuild struct {
+	// Base is the name and optional tag of the image to build from
+	Base string
+	// CloudConfig defines cloud-config YAML applied while building
+	CloudConfig map[string]interface{} `yaml:"cloud_config,omitempty" mapstructure:"cloud_config"`
+	// Shell lists shell commands run after the cloud-config is applied
+	Shell []string `yaml:",omitempty"`
+	// Memory sets the build machine RAM size, 1G by default
+	Memory string `yaml:",omitempty"`
+}
+
+// BuildOptions configures an image build.
+type BuildOptions struct {
+	// Output receives the console output of the build machine
+	Output io.Writer
+	// Timeout limits how long provisioning may take
+	Timeout time.Duration
+}
+
+// Builds returns the image manifests with a build section.
+func (r *ImageRepository) Builds() []*Image {
+	var imgs []*Image
+
+	for _, img := range r.imgs {
+		if img.Build != nil {
+			imgs = append(imgs, img)
+		}
+	}
+
+	return imgs
+}
+
+// Build boots the base image of an image build, provisions it with cloud-init
+// and stores the resulting disk as a new image.
+//
+// The build machine writes to an overlay of the base image. Once cloud-init has
+// finished the machine is powered off, which also resets cloud-init, and the
+// overlay is flattened into a standalone image registered under the name and
+// tags of the manifest.
+func (r *ImageRepository) Build(ctx context.Context, img *Image, opts BuildOptions) (*Image, error) {
+	b := img.Build
+
+	if b == nil {
+		return nil, fmt.Errorf("image %s has no build section", img.Name)
+	}
+
+	arch := img.Arch
+
+	if arch == "" {
+		arch = HostArch()
+	}
+
+	base, err := r.Find(ctx, b.Base, arch)
+
+	if err != nil {
+		return nil, fmt.Errorf("finding base image: %w", err)
+	}
+
+	if err := r.Pull(ctx, base, ImagePullOptions{}); err != nil {
+		return nil, fmt.Errorf("pulling base image: %w", err)
+	}
+
+	buildDir, err := os.MkdirTemp(r.dataDir, "build-")
+
+	if err != nil {
+		return nil, fmt.Errorf("creating build directory: %w", err)
+	}
+
+	defer os.RemoveAll(buildDir)
+
+	disk := path.Join(buildDir, "disk.qcow2")
+
+	if err := createOverlay(ctx, r.ImagePath(base), disk); err != nil {
+		return nil, err
+	}
+
+	memory := b.Memory
+
+	if memory == "" {
+		memory = "1G"
+	}
+
+	conf := &MachineConfig{
+		Image:       b.Base,
+		Memory:      memory,
+		Arch:        arch,
+		CloudConfig: buildCloudConfig(b),
+	}
+
+	m := NewMachine("build-"+img.Name, conf, base, disk)
+
+	if err := runBuildMachine(ctx, m, opts); err != nil {
+		return nil, err
+	}
+
+	tmpPath, err := r.tempImagePath()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.Remove(tmpPath)
+
+	if err := convertImage(ctx, disk, "qcow2", tmpPath); err != nil {
+		return nil, fmt.Errorf("flattening image: %w", err)
+	}
+
+	sum, err := r.storeImage(ctx, tmpPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	username := img.Username
+
+	if username == "" {
+		username = base.Username
+	}
+
+	built := &Image{
+		Name:     img.Name,
+		Checksum: sum,
+		Arch:     arch,
+		Tags:     img.Tags,
+		Username: username,
+	}
+
+	if err := r.Register(built); err != nil {
+		return nil, err
+	}
+
+	return built, nil
+}
+
+// runBuildMachine boots a build machine, waits for cloud-init to finish and powers it off.
+func runBuildMachine(ctx context.Context, m *Machine, opts BuildOptions) error {
+	timeout := opts.Timeout
+
+	if timeout == 0 {
+		timeout = defaultBuildTimeout
+	}
+
+	out := opts.Output
+
+	if out == nil {
+		out = io.Discard
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		return fmt.Errorf("opening IMDS server TCP connection: %w", err)
+	}
+
+	srv := &http.Server{Handler: NewImdsSever([]*Machine{m})}
+
+	go srv.Serve(l)
+
+	defer srv.Close()
+
+	err = m.Start(ctx, &StartOptions{
+		imdsPort:   l.Addr().(*net.TCPAddr).Port,
+		output:     out,
+		persistent: true,
+	})
+
+	if err != nil {
+		return fmt.Errorf("starting build machine: %w", err)
+	}
+
+	exited := make(chan error, 1)
+
+	go func() {
+		exited <- m.Wait()
+	}()
+
+	finished := make(chan error, 1)
+
+	go func() {
+		conn, err := m.Conn()
+
+		if err != nil {
+			finished <- fmt.Errorf("getting machine socket connection: %w", err)
+			return
+		}
+
+		finished <- waitCloudInit(conn, out)
+	}()
+
+	log.Info("Waiting for cloud-init to finish", "machine", m.Name)
+
+	select {
+	case err = <-finished:
+	case err = <-exited:
+		return fmt.Errorf("build machine exited before cloud-init finished: %v", err)
+	case <-time.After(timeout):
+		err = errors.New("timed out waiting for cloud-init to finish")
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		m.lastRun().cmd.Process.Kill()
+		<-exited
+
+		return err
+	}
+
+	log.Info("Powering off build machine", "machine", m.Name)
+
+	if err := m.Powerdown(ctx); err != nil {
+		m.lastRun().cmd.Process.Kill()
+		<-exited
+
+		return fmt.Errorf("powering off build machine: %w", err)
+	}
+
+	select {
+	case err := <-exited:
+		if err != nil {
+			return fmt.Errorf("build machine exited with error: %w", err)
+		}
+	case <-time.After(buildShutdownTimeout):
+		m.lastRun().cmd.Process.Kill()
+		<-exited
+
+		return errors.New("timed out waiting for the build machine to power off")
+	}
+
+	return nil
+}
+
+// waitCloudInit copies console output to w until cloud-init reports that it has finished.
+func waitCloudInit(r io.Reader, w io.Writer) error {
+	s := bufio.NewScanner(r)
+
+	for s.Scan() {
+		line := s.Text()
+
+		fmt.Fprintln(w, line)
+
+		if cloudInitFinished.MatchString(line) {
+			return nil
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("reading console: %w", err)
+	}
+
+	return errors.New("console closed before cloud-init finished")
+}
+
+// buildCloudConfig returns the cloud-config for a build machine.
+// Shell steps run after any commands in the cloud-config, followed by arming the
+// unit which resets cloud-init on shutdown.
+func buildCloudConfig(b *ImageBuild) map[string]interface{} {
+	cc := make(map[string]interface{}, len(b.CloudConfig)+2)
+
+	for k, v := range b.CloudConfig {
+		cc[k] = v
+	}
+
+	var runcmd []interface{}
+
+	if existing, ok := cc["runcmd"].([]interface{}); ok {
+		runcmd = append(runcmd, existing...)
+	}
+
+	for _, step := range b.Shell {
+		runcmd = append(runcmd, []interface{}{"sh", "-c", step})
+	}
+
+	runcmd = append(runcmd, "systemctl start --no-block fog-build-clean.service")
+
+	cc["runcmd"] = runcmd
+
+	var files []interface{}
+
+	if existing, ok := cc["write_files"].([]interface{}); ok {
+		files = append(files, existing...)
+	}
+
+	files = append(files, map[string]interface{}{
+		"path":        "/etc/systemd/system/fog-build-clean.service",
+		"permissions": "0644",
+		"content":     buildCleanUnit,
+	})
+
+	cc["write_files"] = files
+
+	return cc
+}
+
+// createOverlay creates a qcow2 overlay disk backed by an image.
+func createOverlay(ctx context.Context, backing string, dest string) error {
+	out, err := qemuImg(ctx, "create", "-f", "qcow2", "-F", "qcow2", "-b", backing, dest)
+
+	if err != nil {
+		return fmt.Errorf("creating overlay disk: %w: %s", err, out)
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package fog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Catalog is an index of image manifests.
+type Catalog struct {
+	Images []*Image
+}
+
+// catalogPath returns the path of the cached remote catalog.
+func (r *ImageRepository) catalogPath() string {
+	return path.Join(r.dataDir, "catalog.yaml")
+}
+
+// loadCatalog loads the cached remote catalog, if it has been downloaded.
+func (r *ImageRepository) loadCatalog() ([]*Image, error) {
+	buf, err := os.ReadFile(r.catalogPath())
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading catalog: %w", err)
+	}
+
+	cat := Catalog{}
+
+	if err := yaml.Unmarshal(buf, &cat); err != nil {
+		return nil, fmt.Errorf("parsing catalog: %w", err)
+	}
+
+	return cat.Images, nil
+}
+
+// UpdateCatalog downloads the remote catalog index and caches it locally.
+//
+// The index is verified against a SHA256 checksum published next to it with a
+// .sha256 suffix. The number of images in the catalog is returned.
+func (r *ImageRepository) UpdateCatalog(ctx context.Context) (int, error) {
+	if r.catalogUrl == "" {
+		return 0, errors.New("no catalog URL configured")
+	}
+
+	buf, err := fetch(ctx, r.client, r.catalogUrl)
+
+	if err != nil {
+		return 0, fmt.Errorf("downloading catalog: %w", err)
+	}
+
+	sumBuf, err := fetch(ctx, r.client, r.catalogUrl+".sha256")
+
+	if err != nil {
+		return 0, fmt.Errorf("downloading catalog checksum: %w", err)
+	}
+
+	// Accept both a bare checksum and the sha256sum output format
+	fields := strings.Fields(string(sumBuf))
+
+	if len(fields) == 0 {
+		return 0, errors.New("catalog checksum is empty")
+	}
+
+	h := sha256.Sum256(buf)
+
+	if sum := hex.EncodeToString(h[:]); sum != strings.ToLower(fields[0]) {
+		return 0, fmt.Errorf("catalog checksum %s does not match expected sum %s", sum, fields[0])
+	}
+
+	cat := Catalog{}
+
+	if err := yaml.Unmarshal(buf, &cat); err != nil {
+		return 0, fmt.Errorf("parsing catalog: %w", err)
+	}
+
+	for i, img := range cat.Images {
+		if img.Name == "" || (img.Checksum == "" && img.Upstream == nil) {
+			return 0, fmt.Errorf("catalog entry %d is missing a name or checksum", i)
+		}
+	}
+
+	if err := os.MkdirAll(r.dataDir, os.ModePerm); err != nil {
+		return 0, fmt.Errorf("creating data directory: %w", err)
+	}
+
+	tmpPath := r.catalogPath() + ".tmp"
+
+	if err := os.WriteFile(tmpPath, buf, 0644); err != nil {
+		return 0, fmt.Errorf("writing catalog: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, r.catalogPath()); err != nil {
+		return 0, fmt.Errorf("writing catalog: %w", err)
+	}
+
+	return len(cat.Images), nil
+}
+
+// fetch reads the body of a small HTTP resource.
+func fetch(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP error %s", resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
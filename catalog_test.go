@@ -0,0 +1,190 @@
+package fog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const testCatalog = `images:
+  - name: debian
+    tags: [bookworm]
+    arch: x86_64
+    url: https://example.com/debian.qcow2
+    checksum: 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+`
+
+// newTestRepository returns an image repository using a temporary data directory.
+func newTestRepository(t *testing.T, opts RepositoryOptions) *ImageRepository {
+	t.Helper()
+
+	r := NewImageRepository(opts)
+	r.dataDir = t.TempDir()
+	r.dataFs = os.DirFS(r.dataDir)
+	r.manifestDirs = nil
+	r.lockPath = path.Join(r.dataDir, "images.lock")
+
+	return r
+}
+
+// serveCatalog serves a catalog and its checksum file, which is not found if sum is empty.
+func serveCatalog(t *testing.T, catalog string, sum string) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/catalog.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(catalog))
+	})
+
+	mux.HandleFunc("/catalog.yaml.sha256", func(w http.ResponseWriter, r *http.Request) {
+		if sum == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write([]byte(sum + "  catalog.yaml\n"))
+	})
+
+	srv := httptest.NewServer(mux)
+
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func sha256Hex(s string) string {
+	h := sha256.Sum256([]byte(s))
+
+	return hex.EncodeToString(h[:])
+}
+
+func TestUpdateCatalog(t *testing.T) {
+	srv := serveCatalog(t, testCatalog, sha256Hex(testCatalog))
+
+	r := newTestRepository(t, RepositoryOptions{CatalogUrl: srv.URL + "/catalog.yaml"})
+
+	n, err := r.UpdateCatalog(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 1 {
+		t.Fatalf("got %d images, want 1", n)
+	}
+
+	imgs, err := r.loadCatalog()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(imgs) != 1 || imgs[0].Name != "debian" {
+		t.Fatalf("unexpected cached catalog %+v", imgs)
+	}
+}
+
+func TestUpdateCatalogChecksumMismatch(t *testing.T) {
+	srv := serveCatalog(t, testCatalog, sha256Hex("something else"))
+
+	r := newTestRepository(t, RepositoryOptions{CatalogUrl: srv.URL + "/catalog.yaml"})
+
+	_, err := r.UpdateCatalog(context.Background())
+
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+
+	if _, err := os.Stat(r.catalogPath()); err == nil {
+		t.Fatal("catalog was cached despite the checksum mismatch")
+	}
+}
+
+func TestUpdateCatalogMissingChecksum(t *testing.T) {
+	srv := serveCatalog(t, testCatalog, "")
+
+	r := newTestRepository(t, RepositoryOptions{CatalogUrl: srv.URL + "/catalog.yaml"})
+
+	_, err := r.UpdateCatalog(context.Background())
+
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+
+	if _, err := os.Stat(r.catalogPath()); err == nil {
+		t.Fatal("catalog was cached without a checksum")
+	}
+}
+
+func TestManifestPrecedence(t *testing.T) {
+	userDir := t.TempDir()
+	projectDir := t.TempDir()
+
+	r := newTestRepository(t, RepositoryOptions{})
+	r.manifestDirs = []string{userDir, projectDir}
+
+	find := func() *Image {
+		t.Helper()
+
+		if err := r.LoadManifests(); err != nil {
+			t.Fatal(err)
+		}
+
+		img, err := r.Find(context.Background(), "ubuntu:latest", "x86_64")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return img
+	}
+
+	if img := find(); !img.builtin {
+		t.Fatalf("expected the built-in manifest, got %s", img.Checksum)
+	}
+
+	manifest := func(checksum string) []byte {
+		return []byte("name: ubuntu\ntags: [latest]\narch: x86_64\nurl: https://example.com/ubuntu.qcow2\nchecksum: " + checksum + "\n")
+	}
+
+	userSum := strings.Repeat("a", 64)
+
+	if err := os.WriteFile(path.Join(userDir, "ubuntu.yaml"), manifest(userSum), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if img := find(); img.Checksum != userSum {
+		t.Fatalf("expected the user manifest to override the built-in one, got %s", img.Checksum)
+	}
+
+	projectSum := strings.Repeat("b", 64)
+
+	if err := os.WriteFile(path.Join(projectDir, "ubuntu.yaml"), manifest(projectSum), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if img := find(); img.Checksum != projectSum {
+		t.Fatalf("expected the project manifest to override the user one, got %s", img.Checksum)
+	}
+
+	configSum := strings.Repeat("c", 64)
+
+	r.projectImgs = []*Image{{
+		Name:     "ubuntu",
+		Tags:     []string{"latest"},
+		Arch:     "x86_64",
+		Url:      "https://example.com/ubuntu.qcow2",
+		Checksum: configSum,
+	}}
+
+	if img := find(); img.Checksum != configSum {
+		t.Fatalf("expected the project config to override all manifests, got %s", img.Checksum)
+	}
+}
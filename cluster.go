@@ -1,59 +1,174 @@
 package fog
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/charmbracelet/log"
 	"github.com/hashicorp/mdns"
 	"golang.org/x/sync/errgroup"
 )
 
+var (
+	// errShuttingDown is returned when a machine is started while the cluster is shut down
+	errShuttingDown = errors.New("machines are being shut down")
+	// errAlreadyRunning is returned when a running machine is started
+	errAlreadyRunning = errors.New("machine is already running")
+)
+
 // Cluster is a cluster of virtual machines.
 type Cluster struct {
-	conf     *Config
-	r        *ImageRepository
+	conf *Config
+	r    *ImageRepository
+	// store persists the state of the machines
+	store *ProjectStore
+	// started is closed once all machines have been started
+	started chan struct{}
+	// recorded tracks recording the exit of the machines in the store
+	recorded sync.WaitGroup
 	machines []*Machine
-	imdsSrv  *http.Server
-	mdnsSrvs []*mdns.Server
+	// opts are the options the machines are started with
+	opts *StartOptions
+	mux  *LogMux
+	// mu guards starting machines and the fields below
+	mu sync.Mutex
+	// running is the number of running machines
+	running int
+	// idle receives when no machines are running anymore
+	idle chan struct{}
+	// closing is set once the cluster is being shut down
+	closing    bool
+	imdsSrv    *http.Server
+	mdnsSrvs   []*mdns.Server
+	controlSrv *http.Server
 }
 
-func NewCluster(conf *Config, r *ImageRepository) *Cluster {
+func NewCluster(conf *Config, r *ImageRepository, store *ProjectStore) *Cluster {
 	return &Cluster{
-		conf: conf,
-		r:    r,
+		conf:    conf,
+		r:       r,
+		store:   store,
+		started: make(chan struct{}),
+		idle:    make(chan struct{}, 1),
 	}
 }
 
+// Started returns a channel which is closed once Start has started all machines.
+func (c *Cluster) Started() <-chan struct{} {
+	return c.started
+}
+
+// Init loads the machines of the cluster and prepares their disks, pulling their images if needed.
 func (c *Cluster) Init(ctx context.Context) error {
+	return c.init(ctx, nil, func(ctx context.Context, m *Machine) error {
+		return c.prepare(ctx, m, false)
+	})
+}
+
+// InitFromStore loads the machines of the cluster like Init, but only prepares
+// the disks of the named machines. These boot from the disks recorded in the store,
+// so their images aren't pulled and their overlays aren't recreated. The disks
+// of the other machines are prepared when they are booted.
+func (c *Cluster) InitFromStore(ctx context.Context, names ...string) error {
+	return c.init(ctx, names, func(ctx context.Context, m *Machine) error {
+		return c.prepare(ctx, m, true)
+	})
+}
+
+// PullImages loads the machines of the cluster and pulls the images of the
+// named machines, or of all machines if none are named, without preparing their
+// disks. Like with InitFromStore, the images of named machines which boot from
+// the disks recorded in the store aren't pulled. This shows the progress of the
+// downloads when another process, such as a detached supervisor, prepares the disks.
+func (c *Cluster) PullImages(ctx context.Context, names ...string) error {
+	return c.init(ctx, names, func(ctx context.Context, m *Machine) error {
+		if len(names) > 0 {
+			if p, err := c.recordedDisk(m.Name); err != nil || p != "" {
+				return err
+			}
+		}
+
+		return c.pullImage(ctx, m)
+	})
+}
+
+// init loads the machines of the cluster and calls prepare for the named
+// machines, or for all machines if none are named.
+func (c *Cluster) init(ctx context.Context, names []string, prepare func(ctx context.Context, m *Machine) error) error {
 	err := c.r.LoadManifests()
 
 	if err != nil {
 		return err
 	}
 
+	for n, m := range c.conf.Machines {
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("machine %s: %w", n, err)
+		}
+	}
+
+	named := make(map[string]bool)
+
+	for _, n := range names {
+		if _, ok := c.conf.Machines[n]; !ok {
+			return fmt.Errorf("machine %s not found", n)
+		}
+
+		named[n] = true
+	}
+
 	eg, ctx := errgroup.WithContext(ctx)
 
+	var mu sync.Mutex
+
 	for n, m := range c.conf.Machines {
 		n := n
 		m := m
 
 		eg.Go(func() error {
-			img, err := c.r.Find(ctx, m.Image)
+			img, err := c.r.Find(ctx, m.Image, m.MachineArch())
 
 			if err != nil {
 				return err
 			}
 
-			p := c.r.ImagePath(img)
+			machine := NewMachine(n, m, img, "")
 
-			c.machines = append(c.machines, NewMachine(n, m, img, p))
+			// Machines keep their ID, and with it their socket paths, across restarts
+			err = c.store.UpdateMachine(ctx, n, func(st *MachineState) error {
+				if st.ID == "" {
+					st.ID = machine.ID
+				}
 
-			return c.r.Pull(ctx, img, ImagePullOptions{})
+				machine.ID = st.ID
+				st.Image = m.Image
+
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+
+			if len(names) == 0 || named[n] {
+				if err := prepare(ctx, machine); err != nil {
+					return err
+				}
+			}
+
+			mu.Lock()
+			c.machines = append(c.machines, machine)
+			mu.Unlock()
+
+			return nil
 		})
 	}
 
@@ -64,7 +179,126 @@ func (c *Cluster) Init(ctx context.Context) error {
 	return nil
 }
 
-func (c *Cluster) Start(ctx context.Context) error {
+// prepare prepares the disks of a machine, pulling its image if needed.
+//
+// When resuming, the boot disk recorded in the store is used if it still
+// exists, so the machine boots from its existing overlay.
+func (c *Cluster) prepare(ctx context.Context, m *Machine, resume bool) error {
+	p := ""
+
+	var err error
+
+	if resume {
+		if p, err = c.recordedDisk(m.Name); err != nil {
+			return err
+		}
+	}
+
+	if p == "" {
+		if err := c.pullImage(ctx, m); err != nil {
+			return err
+		}
+
+		p = c.r.ImagePath(m.Img)
+
+		if m.Conf.Persistent {
+			p, err = c.persistentDisk(ctx, m.Name, m.Img)
+		} else if m.Conf.DiskSize != "" {
+			p, err = c.scratchDisk(ctx, m.Name, m.Img)
+		}
+
+		if err == nil && m.Conf.DiskSize != "" {
+			err = resizeDisk(ctx, p, m.Conf.DiskSize)
+		}
+
+		if err != nil {
+			return fmt.Errorf("preparing disk of machine %s: %w", m.Name, err)
+		}
+	}
+
+	disks, err := c.dataDisks(ctx, m.Name, m.Conf)
+
+	if err != nil {
+		return fmt.Errorf("preparing disks of machine %s: %w", m.Name, err)
+	}
+
+	m.ImgPath = p
+	m.disks = disks
+	m.prepared = true
+
+	return nil
+}
+
+// recordedDisk returns the boot disk of a machine recorded in the store, or
+// an empty string if none is recorded or it doesn't exist anymore.
+func (c *Cluster) recordedDisk(name string) (string, error) {
+	st, err := c.store.Machine(name)
+
+	if err != nil {
+		return "", err
+	}
+
+	if st != nil && len(st.Disks) > 0 {
+		if _, err := os.Stat(st.Disks[0]); err == nil {
+			return st.Disks[0], nil
+		}
+	}
+
+	return "", nil
+}
+
+// pullImage pulls the image of a machine, recording images of registries in
+// the lock file.
+func (c *Cluster) pullImage(ctx context.Context, m *Machine) error {
+	if err := c.r.Pull(ctx, m.Img, ImagePullOptions{}); err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(m.Conf.Image, ociScheme) {
+		return c.r.lockOci(ctx, m.Img)
+	}
+
+	return nil
+}
+
+// prepareOnce prepares the disks of a machine from the store, unless they
+// have been prepared already.
+func (c *Cluster) prepareOnce(ctx context.Context, m *Machine) error {
+	m.prepareMu.Lock()
+
+	defer m.prepareMu.Unlock()
+
+	if m.prepared {
+		return nil
+	}
+
+	return c.prepare(ctx, m, true)
+}
+
+// Start boots the machines and runs until the context is done or all machines have exited.
+// The machines keep running when the context is done, until they are stopped with Shutdown.
+//
+// Only the named machines are booted if any are given. The other machines
+// can be booted later by other fog processes through the control socket.
+func (c *Cluster) Start(ctx context.Context, names ...string) error {
+	parent := ctx
+
+	boot := c.machines
+
+	if len(names) > 0 {
+		boot = nil
+
+		for _, n := range names {
+			m := c.machine(n)
+
+			if m == nil {
+				return fmt.Errorf("machine %s not found", n)
+			}
+
+			boot = append(boot, m)
+		}
+	}
+
 	eg, ctx := errgroup.WithContext(ctx)
 
 	portChan := make(chan int)
@@ -77,83 +311,287 @@ func (c *Cluster) Start(ctx context.Context) error {
 
 	log.Debug("Started IMDS server", "port", port)
 
-	mux := NewLogMux(ctx, os.Stderr)
+	c.mux = NewLogMux(ctx, os.Stderr)
 
 	log.Debug("Opened mux logger")
 
-	out := mux.Stream("qemu")
+	out := c.mux.Stream("qemu")
 
-	opts := &StartOptions{
+	for _, m := range c.machines {
+		c.mux.Stream(m.Name)
+	}
+
+	c.opts = &StartOptions{
 		imdsPort: port,
 		output:   out,
 	}
 
-	for _, m := range c.machines {
-		m := m
+	for _, m := range boot {
+		if err := c.startMachine(ctx, m); err != nil {
+			return err
+		}
+	}
 
-		err := m.Start(ctx, opts)
+	err := c.startMdnsServers()
 
-		if err != nil {
-			return fmt.Errorf("starting machine %s: %w", m.Name, err)
-		}
+	if err != nil {
+		return fmt.Errorf("starting Mdns server: %w", err)
+	}
 
+	log.Debug("Started MDNS server")
+
+	if c.r.lanSharing {
 		eg.Go(func() error {
-			return m.cmd.Wait()
+			// sharing is best effort and must not stop the machines
+			if err := c.r.ServePeers(ctx); err != nil {
+				log.Warn("Sharing images with peers failed", "error", err)
+			}
+
+			return nil
 		})
+
+		log.Debug("Sharing images with peers")
 	}
 
-	for _, m := range c.machines {
-		m := m
+	l, err := c.listenControl()
 
-		s := mux.Stream(m.Name)
+	if err != nil {
+		return err
+	}
 
-		log.Debug("Created stream", "name", m.Name)
+	c.controlSrv = &http.Server{Handler: c.controlHandler()}
 
-		eg.Go(func() error {
-			c, err := m.Conn()
+	eg.Go(func() error {
+		return c.controlSrv.Serve(l)
+	})
 
-			log.Debug("Opened machine connection", "name", m.Name)
+	log.Debug("Opened control socket")
 
-			if err != nil {
-				return fmt.Errorf("getting machine socket connection: %w", err)
+	close(c.started)
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Unless the caller is done, a server failed
+			if parent.Err() == nil {
+				return ctx.Err()
 			}
 
-			io.Copy(s, c)
+			return nil
+		case <-c.idle:
+		}
+
+		c.mu.Lock()
+		running := c.running
+		c.mu.Unlock()
+
+		// A machine may have been started again in the meantime
+		if running == 0 {
+			log.Info("All machines have exited")
 
 			return nil
-		})
+		}
 	}
+}
 
-	err := c.startMdnsServers()
+// startMachine boots a machine, records it in the store and streams its console.
+func (c *Cluster) startMachine(ctx context.Context, m *Machine) error {
+	c.mu.Lock()
+	closing := c.closing
+	c.mu.Unlock()
 
-	if err != nil {
-		return fmt.Errorf("starting Mdns server: %w", err)
+	if closing {
+		return errShuttingDown
 	}
 
-	log.Debug("Started MDNS server")
+	// Preparing may pull the image, so it must not hold up other machines or shutting down
+	if err := c.prepareOnce(ctx, m); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+
+	defer c.mu.Unlock()
+
+	if c.closing {
+		return errShuttingDown
+	}
+
+	// Another request may have started the machine in the meantime
+	if m.running() {
+		return errAlreadyRunning
+	}
+
+	// The exit of the previous run must be recorded before the new start
+	if m.recorded != nil {
+		<-m.recorded
+	}
+
+	if err := m.Start(ctx, c.opts); err != nil {
+		return fmt.Errorf("starting machine %s: %w", m.Name, err)
+	}
+
+	c.running++
 
-	<-ctx.Done()
+	// The machine is running either way, so a failure to record it isn't fatal
+	if err := c.store.UpdateMachine(ctx, m.Name, m.recordStart); err != nil {
+		log.Warn("Recording machine start failed", "machine", m.Name, "error", err)
+	}
+
+	c.recorded.Add(1)
+
+	recorded := make(chan struct{})
+	m.recorded = recorded
+
+	r := m.lastRun()
 
-	return ctx.Err()
+	go func() {
+		defer c.recorded.Done()
+
+		<-r.exited
+
+		// The context may already be done while the machine is shutting down
+		if err := c.store.UpdateMachine(context.Background(), m.Name, m.recordExit); err != nil {
+			log.Warn("Recording machine exit failed", "machine", m.Name, "error", err)
+		}
+
+		close(recorded)
+		c.release()
+	}()
+
+	s := c.mux.Stream(m.Name)
+
+	go func() {
+		conn, err := m.Conn()
+
+		log.Debug("Opened machine connection", "name", m.Name)
+
+		if err != nil {
+			log.Error("Getting machine socket connection failed", "machine", m.Name, "error", err)
+			return
+		}
+
+		w := c.watchCloudInit(m)
+
+		io.Copy(io.MultiWriter(s, w), conn)
+
+		w.Close()
+	}()
+
+	return nil
 }
 
-func (c *Cluster) Shutdown(ctx context.Context) (err error) {
-	err = c.imdsSrv.Shutdown(ctx)
+// release decrements the number of running machines, and signals Start when none are left.
+func (c *Cluster) release() {
+	c.mu.Lock()
 
-	if err != nil {
-		return fmt.Errorf("shutting down IMDS server: %w", err)
+	defer c.mu.Unlock()
+
+	c.running--
+
+	if c.running == 0 {
+		select {
+		case c.idle <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// machine returns a machine of the cluster by name, or nil if it doesn't exist.
+func (c *Cluster) machine(name string) *Machine {
+	for _, m := range c.machines {
+		if m.Name == name {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// Shutdown powers off the machines gracefully, killing any which don't power
+// off within their stop timeout, and stops the cluster's servers.
+// Machines still running are killed immediately when the context is done.
+func (c *Cluster) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.closing = true
+	c.mu.Unlock()
+
+	if c.controlSrv != nil {
+		c.controlSrv.Close()
+	}
+
+	var wg sync.WaitGroup
+
+	errs := make([]error, len(c.machines))
+
+	for i, m := range c.machines {
+		i, m := i, m
+
+		if m.lastRun() == nil {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			errs[i] = m.Stop(ctx, m.Conf.stopTimeout())
+		}()
+	}
+
+	wg.Wait()
+	c.recorded.Wait()
+
+	// The servers are closed even if a machine failed to stop
+	if c.imdsSrv != nil {
+		if err := c.imdsSrv.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("shutting down IMDS server: %w", err))
+		}
 	}
 
 	for _, s := range c.mdnsSrvs {
-		// preserve the first error
-		if err == nil {
-			err = s.Shutdown()
-		} else {
-			s.Shutdown()
+		if err := s.Shutdown(); err != nil {
+			errs = append(errs, fmt.Errorf("shutting down mDNS server: %w", err))
 		}
 	}
 
-	return err
+	return errors.Join(errs...)
+}
+
+// watchCloudInit returns a writer for a machine's console output, which
+// records in the store once cloud-init has finished.
+func (c *Cluster) watchCloudInit(m *Machine) io.WriteCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		s := bufio.NewScanner(pr)
+
+		for s.Scan() {
+			if !cloudInitFinished.MatchString(s.Text()) {
+				continue
+			}
+
+			err := c.store.UpdateMachine(context.Background(), m.Name, func(st *MachineState) error {
+				if st.Status == MachineRunning {
+					st.CloudInit = CloudInitDone
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				log.Warn("Recording cloud-init status failed", "machine", m.Name, "error", err)
+			}
+
+			break
+		}
+
+		// Keep reading so the console output isn't blocked
+		io.Copy(io.Discard, pr)
+	}()
+
+	return pw
 }
 
 func (c *Cluster) startImdsServer(portChan chan<- int) error {
@@ -167,12 +605,13 @@ func (c *Cluster) startImdsServer(portChan chan<- int) error {
 
 	port := l.Addr().(*net.TCPAddr).Port
 
-	portChan <- port
-
 	srv := &http.Server{Handler: imds}
 
+	// Set before the port is sent, so Shutdown can close the server once Start has received it
 	c.imdsSrv = srv
 
+	portChan <- port
+
 	return srv.Serve(l)
 }
 
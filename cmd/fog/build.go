@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"go.destructure.co/fog"
+)
+
+// buildCmd represents the build command
+var buildCmd = &cobra.Command{
+	Use:   "build",
+	Short: "Build derived images",
+	Long: `Builds images from the build section of their manifests.
+
+The base image is booted and provisioned with the cloud-config and shell steps of
+the build section. Once cloud-init has finished the machine is powered off and its
+disk is stored as a new image, registered under the name and tags of the manifest.
+
+If no images are given, all images with a build section are built.`,
+	Example: "fog build golden:1.0",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		r, err := loadImageRepository()
+
+		if err != nil {
+			return err
+		}
+
+		var imgs []*fog.Image
+
+		for _, img := range r.Builds() {
+			if len(args) == 0 {
+				imgs = append(imgs, img)
+				continue
+			}
+
+			for _, arg := range args {
+				name, tag, err := fog.ParseImageName(arg)
+
+				if err != nil {
+					return err
+				}
+
+				if img.Name == name && hasTag(img, tag) {
+					imgs = append(imgs, img)
+				}
+			}
+		}
+
+		if len(imgs) == 0 {
+			return fmt.Errorf("no images to build")
+		}
+
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+
+		mux := fog.NewLogMux(ctx, os.Stderr)
+
+		for _, img := range imgs {
+			fmt.Printf("Building %s...\n", img.Name)
+
+			built, err := r.Build(ctx, img, fog.BuildOptions{
+				Output:  mux.Stream(img.Name),
+				Timeout: timeout,
+			})
+
+			if err != nil {
+				return fmt.Errorf("building %s: %w", img.Name, err)
+			}
+
+			fmt.Printf("Built %s %s\n", built.Name, fog.ShortChecksum(built.Checksum))
+		}
+
+		return nil
+	},
+}
+
+// hasTag reports whether an image has a tag.
+func hasTag(img *fog.Image, tag string) bool {
+	for _, t := range img.Tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+func init() {
+	buildCmd.Flags().Duration("timeout", 0, "Maximum time to wait for provisioning (default 30m)")
+
+	rootCmd.AddCommand(buildCmd)
+}
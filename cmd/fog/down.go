@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"go.destructure.co/fog"
+)
+
+// downCmd represents the down command
+var downCmd = &cobra.Command{
+	Use:   "down [machine...]",
+	Short: "Stop and remove virtual machines",
+	Long: `Powers off the project's machines, or only the given machines, and stops the process running them.
+
+Machines which don't power off within their stop_timeout are killed. With --volumes the state of the
+machines is removed as well, including persistent disks, so they boot from a fresh disk next time.
+Single machines can only be removed this way while the project is not running.
+
+Machines which are not running are skipped, so fog down can be run repeatedly.`,
+	Example: "fog down --volumes",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		volumes, err := cmd.Flags().GetBool("volumes")
+
+		if err != nil {
+			return err
+		}
+
+		conf, err := loadProjectConfig()
+
+		if err != nil {
+			return err
+		}
+
+		store, err := openProjectStore(conf)
+
+		if err != nil {
+			return err
+		}
+
+		names, err := projectMachines(conf, store)
+
+		if err != nil {
+			return err
+		}
+
+		if len(args) > 0 {
+			for _, n := range args {
+				if !contains(names, n) {
+					return fmt.Errorf("machine %s not found", n)
+				}
+			}
+
+			names = args
+
+			// The process running the project still boots the machines from their disks
+			if volumes {
+				proj, err := store.Project()
+
+				if err != nil {
+					return err
+				}
+
+				if proj != nil {
+					return fmt.Errorf("can't remove the volumes of single machines while the project is running (pid %d), take down the whole project instead", proj.Pid)
+				}
+			}
+		}
+
+		results := make([]string, len(names))
+		errs := make([]error, len(names))
+
+		var wg sync.WaitGroup
+
+		for i, n := range names {
+			i, n := i, n
+
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				results[i], errs[i] = store.StopMachine(ctx, n)
+			}()
+		}
+
+		wg.Wait()
+
+		// The process running the machines exits once all have stopped
+		if len(args) == 0 {
+			if _, err := store.StopProject(ctx); err != nil {
+				return err
+			}
+		}
+
+		for i, n := range names {
+			if errs[i] == nil && volumes {
+				var removed bool
+
+				if removed, errs[i] = store.RemoveMachine(ctx, n); removed {
+					results[i] += ", volumes removed"
+				}
+			}
+
+			if errs[i] != nil {
+				fmt.Printf("%s: failed: %s\n", n, errs[i])
+				continue
+			}
+
+			fmt.Printf("%s: %s\n", n, results[i])
+		}
+
+		if err := errors.Join(errs...); err != nil {
+			return errors.New("failed to take down some machines")
+		}
+
+		return nil
+	},
+}
+
+// projectMachines returns the names of the machines in the project config and
+// of any machines recorded in the state store, which may have been removed from the config.
+func projectMachines(conf *fog.Config, store *fog.ProjectStore) ([]string, error) {
+	var names []string
+
+	for n := range conf.Machines {
+		names = append(names, n)
+	}
+
+	states, err := store.Machines()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, st := range states {
+		if !contains(names, st.Name) {
+			names = append(names, st.Name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// contains reports whether a list of strings contains a string.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func init() {
+	downCmd.Flags().Bool("volumes", false, "remove persistent disks and other machine state")
+
+	rootCmd.AddCommand(downCmd)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.destructure.co/fog"
+)
+
+// imagesCmd represents the images command
+var imagesCmd = &cobra.Command{
+	Use:   "images",
+	Short: "Manage images",
+	Long:  `Manages the virtual machine images known to fog and stored locally.`,
+}
+
+func init() {
+	rootCmd.AddCommand(imagesCmd)
+}
+
+// loadImageRepository creates an image repository and loads the manifests available to the project.
+func loadImageRepository() (*fog.ImageRepository, error) {
+	conf, err := loadProjectConfig()
+
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := newImageRepository(conf)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.LoadManifests(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// checksumPrefixPattern matches image references which are long enough to be taken as a checksum prefix.
+var checksumPrefixPattern = regexp.MustCompile(`^[0-9a-f]{12,64}$`)
+
+// findImage finds a stored image by manifest name and tag, or by checksum.
+//
+// Names take precedence over checksums. A checksum prefix must either be
+// given as sha256:<prefix> or be at least 12 characters long, so short names
+// such as "beef" are never mistaken for a checksum.
+func findImage(ctx context.Context, r *fog.ImageRepository, ref string) (*fog.Image, *fog.LocalImage, error) {
+	if sum, ok := strings.CutPrefix(ref, "sha256:"); ok {
+		l, err := r.FindLocal(sum)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return nil, l, nil
+	}
+
+	img, err := r.Find(ctx, ref, "")
+
+	if err != nil {
+		if !checksumPrefixPattern.MatchString(ref) {
+			return nil, nil, err
+		}
+
+		l, lerr := r.FindLocal(ref)
+
+		if lerr != nil {
+			return nil, nil, err
+		}
+
+		return nil, l, nil
+	}
+
+	if img.Checksum == "" {
+		return img, nil, nil
+	}
+
+	l, err := r.FindLocal(img.Checksum)
+
+	if err != nil {
+		return img, nil, nil
+	}
+
+	return img, l, nil
+}
+
+// formatSize formats a byte count for humans.
+func formatSize(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"go.destructure.co/fog"
+)
+
+// imagesImportCmd represents the images import command
+var imagesImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import a local disk image",
+	Long: `Imports a local disk image into the image store and registers a manifest for it.
+
+Images in formats other than qcow2, such as raw or vmdk, are converted with qemu-img.
+A qcow2 overlay is flattened into a standalone image, since its backing file isn't imported.
+The manifest is written to the user's image manifest directory so the image can be
+used by name and tag in any project.`,
+	Example: "fog images import ./output/disk.qcow2 --name golden --tag 1.0 --username ubuntu",
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		r, err := loadImageRepository()
+
+		if err != nil {
+			return err
+		}
+
+		opts := fog.ImportOptions{}
+
+		opts.Name, _ = cmd.Flags().GetString("name")
+		opts.Tag, _ = cmd.Flags().GetString("tag")
+		opts.Arch, _ = cmd.Flags().GetString("arch")
+		opts.Username, _ = cmd.Flags().GetString("username")
+		opts.Format, _ = cmd.Flags().GetString("format")
+
+		img, err := r.Import(ctx, args[0], opts)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Imported %s:%s %s\n", img.Name, img.Tags[0], fog.ShortChecksum(img.Checksum))
+
+		return nil
+	},
+}
+
+func init() {
+	imagesImportCmd.Flags().String("name", "", "Name of the image")
+	imagesImportCmd.Flags().String("tag", "latest", "Tag of the image")
+	imagesImportCmd.Flags().String("arch", fog.HostArch(), "Architecture of the image")
+	imagesImportCmd.Flags().String("username", "", "Default user of the image")
+	imagesImportCmd.Flags().String("format", "", "Disk format of the file, detected by default")
+
+	imagesImportCmd.MarkFlagRequired("name")
+
+	imagesCmd.AddCommand(imagesImportCmd)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// imagesInspectCmd represents the images inspect command
+var imagesInspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "Show details of an image",
+	Long: `Shows the manifest and local path of an image.
+
+An image is referenced by name and tag, or by a stored image's checksum. A checksum prefix must
+be at least 12 characters long, or be written as sha256:<prefix>.`,
+	Example: "fog images inspect ubuntu:jammy",
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		r, err := loadImageRepository()
+
+		if err != nil {
+			return err
+		}
+
+		img, l, err := findImage(ctx, r, args[0])
+
+		if err != nil {
+			return err
+		}
+
+		if img != nil {
+			buf, err := yaml.Marshal(img)
+
+			if err != nil {
+				return fmt.Errorf("encoding manifest: %w", err)
+			}
+
+			os.Stdout.Write(buf)
+		}
+
+		if l == nil {
+			fmt.Println("# not pulled")
+
+			return nil
+		}
+
+		if img == nil {
+			fmt.Printf("checksum: %s\n", l.Checksum)
+		}
+
+		fmt.Printf("path: %s\n", l.Path)
+		fmt.Printf("size: %d\n", l.Size)
+		fmt.Printf("pulled: %s\n", l.Pulled.Format("2006-01-02T15:04:05Z07:00"))
+
+		return nil
+	},
+}
+
+func init() {
+	imagesCmd.AddCommand(imagesInspectCmd)
+}
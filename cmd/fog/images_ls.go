@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+	"go.destructure.co/fog"
+)
+
+// imagesLsCmd represents the images ls command
+var imagesLsCmd = &cobra.Command{
+	Use:     "ls",
+	Aliases: []string{"list"},
+	Short:   "List images",
+	Long: `Lists the images known from manifests and configured providers, and the images stored locally.
+
+Stored images which are not referenced by any manifest are listed with the name "<none>".`,
+	Example: "fog images ls",
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		r, err := loadImageRepository()
+
+		if err != nil {
+			return err
+		}
+
+		imgs, err := r.Images()
+
+		if err != nil {
+			return err
+		}
+
+		// Providers may be unreachable, which shouldn't hide the local images
+		pimgs, err := r.ProviderImages(cmd.Context())
+
+		if err != nil {
+			log.Warn("Listing provider images failed", "error", err)
+		}
+
+		imgs = append(imgs, pimgs...)
+
+		locals, err := r.LocalImages()
+
+		if err != nil {
+			return err
+		}
+
+		listed := make(map[string]bool)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+
+		fmt.Fprintln(w, "NAME\tTAGS\tARCH\tCHECKSUM\tSIZE\tPULLED")
+
+		for _, img := range imgs {
+			sum, size, pulled := "-", "-", "-"
+
+			if img.Checksum != "" {
+				sum = fog.ShortChecksum(img.Checksum)
+			}
+
+			for _, l := range locals {
+				if l.Checksum == img.Checksum {
+					size = formatSize(l.Size)
+					pulled = l.Pulled.Format("2006-01-02 15:04")
+					listed[l.Checksum] = true
+				}
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", img.Name, strings.Join(img.Tags, ","), img.Arch, sum, size, pulled)
+		}
+
+		for _, l := range locals {
+			if listed[l.Checksum] {
+				continue
+			}
+
+			fmt.Fprintf(w, "<none>\t-\t-\t%s\t%s\t%s\n", fog.ShortChecksum(l.Checksum), formatSize(l.Size), l.Pulled.Format("2006-01-02 15:04"))
+		}
+
+		return w.Flush()
+	},
+}
+
+func init() {
+	imagesCmd.AddCommand(imagesLsCmd)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"go.destructure.co/fog"
+)
+
+// imagesPruneCmd represents the images prune command
+var imagesPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove unreferenced images",
+	Long: `Removes stored images which are not referenced by any manifest or the lock file of any project.
+Registry images used by a project's machines are recorded in its lock file when they are pulled.`,
+	Example: "fog images prune",
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		r, err := loadImageRepository()
+
+		if err != nil {
+			return err
+		}
+
+		pruned, err := r.Prune(ctx)
+
+		var total int64
+
+		for _, l := range pruned {
+			fmt.Printf("Removed %s\n", fog.ShortChecksum(l.Checksum))
+
+			total += l.Size
+		}
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Reclaimed %s\n", formatSize(total))
+
+		return nil
+	},
+}
+
+func init() {
+	imagesCmd.AddCommand(imagesPruneCmd)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"go.destructure.co/fog"
+)
+
+// imagesPushCmd represents the images push command
+var imagesPushCmd = &cobra.Command{
+	Use:   "push",
+	Short: "Push an image to an OCI registry",
+	Long: `Pushes a stored image to an OCI registry.
+
+The qcow2 disk is pushed as a single layer artifact which can be used as an image
+with an oci:// reference, for example "image: oci://registry.local/vm/golden:1.0".
+Credentials are read from the Docker config file.`,
+	Example: "fog images push golden:1.0 oci://registry.local/vm/golden:1.0",
+	Args:    cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		if !strings.HasPrefix(args[1], "oci://") {
+			return fmt.Errorf("destination must be an oci:// reference")
+		}
+
+		r, err := loadImageRepository()
+
+		if err != nil {
+			return err
+		}
+
+		img, l, err := findImage(ctx, r, args[0])
+
+		if err != nil {
+			return err
+		}
+
+		if l == nil {
+			return fmt.Errorf("image %s is not stored locally, pull it first", args[0])
+		}
+
+		if img == nil {
+			img = &fog.Image{Name: fog.ShortChecksum(l.Checksum), Checksum: l.Checksum}
+		}
+
+		if err := r.Push(ctx, img, args[1]); err != nil {
+			return err
+		}
+
+		fmt.Printf("Pushed %s to %s\n", fog.ShortChecksum(l.Checksum), args[1])
+
+		return nil
+	},
+}
+
+func init() {
+	imagesCmd.AddCommand(imagesPushCmd)
+}
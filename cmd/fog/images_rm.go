@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"go.destructure.co/fog"
+)
+
+// imagesRmCmd represents the images rm command
+var imagesRmCmd = &cobra.Command{
+	Use:     "rm",
+	Aliases: []string{"remove"},
+	Short:   "Remove stored images",
+	Long: `Removes one or more images from the local image store.
+
+An image is referenced by name and tag, or by a stored image's checksum. A checksum prefix must
+be at least 12 characters long, or be written as sha256:<prefix>.
+The manifest of the image is not affected, so it can be pulled again later.`,
+	Example: "fog images rm ubuntu:jammy",
+	Args:    cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		r, err := loadImageRepository()
+
+		if err != nil {
+			return err
+		}
+
+		for _, ref := range args {
+			_, l, err := findImage(ctx, r, ref)
+
+			if err != nil {
+				return err
+			}
+
+			if l == nil {
+				return fmt.Errorf("image %s is not stored locally", ref)
+			}
+
+			if _, err := r.Remove(ctx, l.Checksum); err != nil {
+				return err
+			}
+
+			fmt.Printf("Removed %s\n", fog.ShortChecksum(l.Checksum))
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	imagesCmd.AddCommand(imagesRmCmd)
+}
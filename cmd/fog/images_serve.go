@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// imagesServeCmd represents the images serve command
+var imagesServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Share stored images on the local network",
+	Long: `Advertises the stored images over mDNS and serves them to other fog instances on the local network until interrupted.
+
+Other instances fetch images from peers before downloading them when lan_sharing is enabled in their global config.
+Images from peers are always verified against the checksum of the manifest.`,
+	Example: "fog images serve",
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		r, err := loadImageRepository()
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Sharing images on the local network...")
+
+		return r.ServePeers(ctx)
+	},
+}
+
+func init() {
+	imagesCmd.AddCommand(imagesServeCmd)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// imagesUpdateCmd represents the images update command
+var imagesUpdateCmd = &cobra.Command{
+	Use:   "update",
+	Short: "Update the remote image catalog",
+	Long: `Downloads the remote image catalog and caches it locally.
+
+The catalog URL is set with the "catalog_url" global config setting. Images in the
+catalog override the built-in image manifests.`,
+	Example: "fog images update",
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		conf, err := loadProjectConfig()
+
+		if err != nil {
+			return err
+		}
+
+		r, err := newImageRepository(conf)
+
+		if err != nil {
+			return err
+		}
+
+		n, err := r.UpdateCatalog(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Updated catalog with %d images\n", n)
+
+		return nil
+	},
+}
+
+func init() {
+	imagesCmd.AddCommand(imagesUpdateCmd)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// logsCmd represents the logs command
+var logsCmd = &cobra.Command{
+	Use:   "logs",
+	Short: "Show the output of detached machines",
+	Long: `Shows the output of the machines started with fog up --detach, including their serial consoles.
+
+With --follow new output is shown as it is written until interrupted or the machines stop.`,
+	Example: "fog logs -f",
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+
+		follow, err := cmd.Flags().GetBool("follow")
+
+		if err != nil {
+			return err
+		}
+
+		conf, err := loadProjectConfig()
+
+		if err != nil {
+			return err
+		}
+
+		store, err := openProjectStore(conf)
+
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(store.LogPath())
+
+		if errors.Is(err, fs.ErrNotExist) {
+			return errors.New("no logs found, the project has not been started with fog up --detach")
+		}
+
+		if err != nil {
+			return fmt.Errorf("opening log file: %w", err)
+		}
+
+		defer f.Close()
+
+		for {
+			if _, err := io.Copy(os.Stdout, f); err != nil {
+				return err
+			}
+
+			if !follow {
+				return nil
+			}
+
+			proj, err := store.Project()
+
+			if err != nil {
+				return err
+			}
+
+			if proj == nil || !proj.Detached {
+				// Show anything written while the supervisor exited
+				_, err := io.Copy(os.Stdout, f)
+
+				return err
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(200 * time.Millisecond):
+			}
+		}
+	},
+}
+
+func init() {
+	logsCmd.Flags().BoolP("follow", "f", false, "follow the log output")
+
+	rootCmd.AddCommand(logsCmd)
+}
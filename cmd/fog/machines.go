@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"go.destructure.co/fog"
+)
+
+// machineAction is a lifecycle operation on a machine, which returns its result.
+type machineAction func(ctx context.Context, name string) (string, error)
+
+// addAllFlag adds the --all flag to a command operating on machines.
+func addAllFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("all", false, "apply to all machines of the project")
+}
+
+// machineArgs returns the machines named in the arguments, or all machines of the project with --all.
+func machineArgs(cmd *cobra.Command, args []string, conf *fog.Config, store *fog.ProjectStore) ([]string, error) {
+	all, err := cmd.Flags().GetBool("all")
+
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := projectMachines(conf, store)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if all {
+		if len(args) > 0 {
+			return nil, errors.New("machine names can't be combined with --all")
+		}
+
+		return names, nil
+	}
+
+	if len(args) == 0 {
+		return nil, errors.New("no machines given, pass machine names or --all")
+	}
+
+	for _, n := range args {
+		if !contains(names, n) {
+			return nil, fmt.Errorf("machine %s not found", n)
+		}
+	}
+
+	return args, nil
+}
+
+// runMachines runs an action on machines concurrently and prints the result for each machine.
+func runMachines(ctx context.Context, names []string, action machineAction) error {
+	results := make([]string, len(names))
+	errs := make([]error, len(names))
+
+	var wg sync.WaitGroup
+
+	for i, n := range names {
+		i, n := i, n
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			results[i], errs[i] = action(ctx, n)
+		}()
+	}
+
+	wg.Wait()
+
+	failed := 0
+
+	for i, n := range names {
+		if errs[i] != nil {
+			fmt.Printf("%s: failed: %s\n", n, errs[i])
+			failed++
+
+			continue
+		}
+
+		fmt.Printf("%s: %s\n", n, results[i])
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d machines failed", failed, len(names))
+	}
+
+	return nil
+}
+
+// startMachines boots stopped machines through the process running the
+// project, or starts a background supervisor for them if the project isn't running.
+func startMachines(ctx context.Context, store *fog.ProjectStore, names []string, action machineAction) error {
+	proj, err := store.Project()
+
+	if err != nil {
+		return err
+	}
+
+	if proj != nil {
+		return runMachines(ctx, names, action)
+	}
+
+	if err := upDetached(ctx, names); err != nil {
+		return err
+	}
+
+	for _, n := range names {
+		fmt.Printf("%s: %s\n", n, fog.ResultStarted)
+	}
+
+	return nil
+}
@@ -3,14 +3,19 @@ package main
 import (
 	"context"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	defer stop()
 
 	err := rootCmd.ExecuteContext(ctx)
 
 	if err != nil {
+		stop()
 		os.Exit(1)
 	}
 }
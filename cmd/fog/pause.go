@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// pauseCmd represents the pause command
+var pauseCmd = &cobra.Command{
+	Use:   "pause [machine...]",
+	Short: "Pause virtual machines",
+	Long: `Pauses the CPUs of the given machines, or all machines with --all. Paused machines keep their memory
+and can be resumed with fog unpause.`,
+	Example: "fog pause web",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := loadProjectConfig()
+
+		if err != nil {
+			return err
+		}
+
+		store, err := openProjectStore(conf)
+
+		if err != nil {
+			return err
+		}
+
+		names, err := machineArgs(cmd, args, conf, store)
+
+		if err != nil {
+			return err
+		}
+
+		return runMachines(cmd.Context(), names, store.PauseMachine)
+	},
+}
+
+func init() {
+	addAllFlag(pauseCmd)
+
+	rootCmd.AddCommand(pauseCmd)
+}
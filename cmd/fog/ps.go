@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+	"go.destructure.co/fog"
+)
+
+// psTimeout limits how long querying the run state of a machine may take.
+const psTimeout = 5 * time.Second
+
+// machineInfo is the status of a machine as shown by fog ps.
+type machineInfo struct {
+	Name string
+	// Image is the name and tag of the machine's image
+	Image string
+	// State is the QEMU run state of a running machine, or else its recorded status
+	State   string
+	Started *time.Time `json:",omitempty"`
+	Uptime  string     `json:",omitempty"`
+	// Ports are the forwarded ports as host->guest mappings
+	Ports     []string
+	CloudInit string `json:",omitempty"`
+	Pid       int    `json:",omitempty"`
+}
+
+// psCmd represents the ps command
+var psCmd = &cobra.Command{
+	Use:     "ps",
+	Aliases: []string{"status"},
+	Short:   "List machines",
+	Long: `Lists the project's machines with their image, run state, uptime, forwarded ports, cloud-init status
+and QEMU process ID.
+
+The run state of running machines is queried from QEMU, so paused machines are shown as paused.
+Machines are listed whether they were started in the foreground or with fog up --detach.
+
+With --format json the machines are printed as JSON. Any other format is a Go template which is
+applied to each machine, for example '{{.Name}} {{.State}}'.`,
+	Example: "fog ps --format '{{.Name}}: {{.CloudInit}}'",
+	Args:    cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, err := cmd.Flags().GetString("format")
+
+		if err != nil {
+			return err
+		}
+
+		conf, err := loadProjectConfig()
+
+		if err != nil {
+			return err
+		}
+
+		store, err := openProjectStore(conf)
+
+		if err != nil {
+			return err
+		}
+
+		names, err := projectMachines(conf, store)
+
+		if err != nil {
+			return err
+		}
+
+		infos := []*machineInfo{}
+
+		for _, n := range names {
+			info, err := inspectMachine(cmd.Context(), conf, store, n)
+
+			if err != nil {
+				return err
+			}
+
+			infos = append(infos, info)
+		}
+
+		switch format {
+		case "":
+			return printMachines(infos)
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.SetEscapeHTML(false)
+
+			return enc.Encode(infos)
+		}
+
+		tmpl, err := template.New("format").Parse(format)
+
+		if err != nil {
+			return fmt.Errorf("parsing format template: %w", err)
+		}
+
+		for _, info := range infos {
+			if err := tmpl.Execute(os.Stdout, info); err != nil {
+				return err
+			}
+
+			fmt.Println()
+		}
+
+		return nil
+	},
+}
+
+// inspectMachine returns the status of a machine from the state store and,
+// if the machine is running, from QEMU.
+func inspectMachine(ctx context.Context, conf *fog.Config, store *fog.ProjectStore, name string) (*machineInfo, error) {
+	st, err := store.Machine(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info := &machineInfo{Name: name, State: "not created"}
+
+	ref := ""
+
+	if mc, ok := conf.Machines[name]; ok {
+		ref = mc.Image
+	}
+
+	if st != nil {
+		ref = st.Image
+		info.State = st.Status
+	}
+
+	if ref != "" {
+		n, tag, err := fog.ParseImageName(ref)
+
+		if err == nil {
+			ref = n + ":" + tag
+		}
+
+		info.Image = ref
+	}
+
+	if st == nil || st.Status != fog.MachineRunning {
+		return info, nil
+	}
+
+	info.Started = &st.Started
+	info.Uptime = time.Since(st.Started).Round(time.Second).String()
+	info.CloudInit = st.CloudInit
+	info.Pid = st.Pid
+
+	for _, p := range st.Ports {
+		info.Ports = append(info.Ports, formatPort(p))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, psTimeout)
+
+	defer cancel()
+
+	// The recorded status is shown if QEMU doesn't respond
+	if rs, err := st.RunState(ctx); err != nil {
+		log.Warn("Querying machine state failed", "machine", name, "error", err)
+	} else {
+		info.State = rs.Status
+	}
+
+	return info, nil
+}
+
+// printMachines prints the status of machines as a table.
+func printMachines(infos []*machineInfo) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+
+	fmt.Fprintln(w, "NAME\tIMAGE\tSTATE\tUPTIME\tPORTS\tCLOUD-INIT\tPID")
+
+	for _, info := range infos {
+		uptime, ports, cloudInit, pid := "-", "-", "-", "-"
+
+		if info.Uptime != "" {
+			uptime = info.Uptime
+		}
+
+		if len(info.Ports) > 0 {
+			ports = strings.Join(info.Ports, ",")
+		}
+
+		if info.CloudInit != "" {
+			cloudInit = info.CloudInit
+		}
+
+		if info.Pid != 0 {
+			pid = fmt.Sprint(info.Pid)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", info.Name, info.Image, info.State, uptime, ports, cloudInit, pid)
+	}
+
+	return w.Flush()
+}
+
+// formatPort formats a QEMU port forwarding rule, such as tcp::2222-:22, as 2222->22/tcp.
+// Rules which can't be parsed are returned as is.
+func formatPort(rule string) string {
+	// The guest part never contains a dash, unlike a host port range
+	i := strings.LastIndex(rule, "-")
+
+	if i < 0 {
+		return rule
+	}
+
+	host, guest := rule[:i], rule[i+1:]
+
+	proto, host, ok := strings.Cut(host, ":")
+
+	if !ok {
+		return rule
+	}
+
+	// An empty host address listens on all addresses
+	host = strings.TrimPrefix(host, ":")
+
+	if i := strings.LastIndex(guest, ":"); i >= 0 {
+		guest = guest[i+1:]
+	}
+
+	if proto == "" {
+		proto = "tcp"
+	}
+
+	return fmt.Sprintf("%s->%s/%s", host, guest, proto)
+}
+
+func init() {
+	psCmd.Flags().String("format", "", "print machines as json or with a Go template")
+
+	rootCmd.AddCommand(psCmd)
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestFormatPort(t *testing.T) {
+	tests := []struct {
+		rule string
+		want string
+	}{
+		{rule: "tcp::2222-:22", want: "2222->22/tcp"},
+		{rule: "::8080-:80", want: "8080->80/tcp"},
+		{rule: "udp::5353-:53", want: "5353->53/udp"},
+		{rule: "tcp:127.0.0.1:2222-:22", want: "127.0.0.1:2222->22/tcp"},
+		{rule: "tcp::2222-10.0.2.15:22", want: "2222->22/tcp"},
+		{rule: "tcp::8000-8010-:80", want: "8000-8010->80/tcp"},
+		{rule: "tcp::2222", want: "tcp::2222"},
+		{rule: "2222-22", want: "2222-22"},
+		{rule: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := formatPort(tt.rule); got != tt.want {
+			t.Errorf("formatPort(%q) = %s, want %s", tt.rule, got, tt.want)
+		}
+	}
+}
@@ -11,30 +11,61 @@ var pullCmd = &cobra.Command{
 	Short: "Pull an image from a remote source",
 	Long: `Pulls an image from a remote source and stores it locally.
 	
-An image is pulled by name and tag. If the tag is not specified the "latest" tag is pulled.`,
+An image is pulled by name and tag. If the tag is not specified the "latest" tag is pulled.
+
+Images with upstream metadata are pulled at the build recorded in the lock file. Use
+--refresh to resolve and record the newest build instead.
+
+Interrupted downloads are resumed by the next pull unless --remove-partial is set.`,
 	Example: "fog pull ubuntu:latest",
 	Args:    cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 
 		ctx := cmd.Context()
 
-		r := fog.NewImageRepository()
+		conf, err := loadProjectConfig()
+
+		if err != nil {
+			return err
+		}
+
+		r, err := newImageRepository(conf)
+
+		if err != nil {
+			return err
+		}
 
 		rawImg := args[0]
 
-		err := r.LoadManifests()
+		err = r.LoadManifests()
 
 		if err != nil {
 			return err
 		}
 
-		img, err := r.Find(ctx, rawImg)
+		find := r.Find
+
+		if refresh, _ := cmd.Flags().GetBool("refresh"); refresh {
+			find = r.Refresh
+		}
+
+		arch, _ := cmd.Flags().GetString("arch")
+
+		img, err := find(ctx, rawImg, arch)
 
 		if err != nil {
 			return err
 		}
 
-		err = r.Pull(ctx, img, fog.ImagePullOptions{})
+		retries, _ := cmd.Flags().GetInt("retries")
+		removePartial, _ := cmd.Flags().GetBool("remove-partial")
+
+		err = r.Pull(ctx, img, fog.ImagePullOptions{
+			Download: fog.DownloadOptions{
+				Retries:       retries,
+				RemovePartial: removePartial,
+			},
+		})
 
 		if err != nil {
 			return err
@@ -45,5 +76,10 @@ An image is pulled by name and tag. If the tag is not specified the "latest" tag
 }
 
 func init() {
+	pullCmd.Flags().String("arch", fog.HostArch(), "Architecture of the image")
+	pullCmd.Flags().Bool("refresh", false, "Resolve images with upstream metadata to the newest build")
+	pullCmd.Flags().Int("retries", 0, "Number of times to retry a failed download, negative to disable (default 5)")
+	pullCmd.Flags().Bool("remove-partial", false, "Remove partially downloaded files on failure instead of resuming them later")
+
 	rootCmd.AddCommand(pullCmd)
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// restartCmd represents the restart command
+var restartCmd = &cobra.Command{
+	Use:   "restart [machine...]",
+	Short: "Restart virtual machines",
+	Long: `Powers off the given machines, or all machines with --all, and boots them again from their existing
+disks. Machines which are stopped are booted.
+
+Machines which don't power off within their stop_timeout are killed.`,
+	Example: "fog restart web",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := loadProjectConfig()
+
+		if err != nil {
+			return err
+		}
+
+		store, err := openProjectStore(conf)
+
+		if err != nil {
+			return err
+		}
+
+		names, err := machineArgs(cmd, args, conf, store)
+
+		if err != nil {
+			return err
+		}
+
+		return startMachines(cmd.Context(), store, names, store.RestartMachine)
+	},
+}
+
+func init() {
+	addAllFlag(restartCmd)
+
+	rootCmd.AddCommand(restartCmd)
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"fmt"
+	"path/filepath"
+
 	"github.com/adrg/xdg"
 	"github.com/charmbracelet/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"go.destructure.co/fog"
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -58,3 +62,96 @@ func initProjectConfig() {
 		log.Debug("Loaded project config", "file", projectConfig.ConfigFileUsed())
 	}
 }
+
+// projectDir returns the root directory of the current project, or an empty string if no project config was found.
+func projectDir() string {
+	file := projectConfig.ConfigFileUsed()
+
+	if file == "" {
+		return ""
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(file))
+
+	if err != nil {
+		return ""
+	}
+
+	if filepath.Base(dir) == ".fog" {
+		dir = filepath.Dir(dir)
+	}
+
+	return dir
+}
+
+// loadGlobalConfig unmarshals the global config.
+func loadGlobalConfig() (*fog.GlobalConfig, error) {
+	conf := &fog.GlobalConfig{}
+
+	if err := globalConfig.Unmarshal(conf); err != nil {
+		return nil, fmt.Errorf("parsing global config: %w", err)
+	}
+
+	return conf, nil
+}
+
+// loadProjectConfig unmarshals the project config.
+func loadProjectConfig() (*fog.Config, error) {
+	conf := &fog.Config{}
+
+	if err := projectConfig.Unmarshal(conf); err != nil {
+		return nil, fmt.Errorf("parsing project config: %w", err)
+	}
+
+	for n, m := range conf.Machines {
+		m.CloudConfig = projectConfig.GetStringMap(fmt.Sprintf("machines.%s.cloud_config", n))
+	}
+
+	return conf, nil
+}
+
+// openProjectStore opens the state store of the project.
+func openProjectStore(conf *fog.Config) (*fog.ProjectStore, error) {
+	return fog.OpenProjectStore(projectDir(), conf.Name)
+}
+
+// newImageRepository creates an image repository using the manifests available to the project.
+func newImageRepository(conf *fog.Config) (*fog.ImageRepository, error) {
+	gconf, err := loadGlobalConfig()
+
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := fog.NewHTTPClient(gconf)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var providers []fog.ImageProvider
+
+	for _, pconf := range gconf.Providers {
+		p, err := fog.NewProvider(pconf, client)
+
+		if err != nil {
+			return nil, err
+		}
+
+		providers = append(providers, p)
+	}
+
+	r := fog.NewImageRepository(fog.RepositoryOptions{
+		ProjectDir:      projectDir(),
+		Images:          conf.Images,
+		CatalogUrl:      gconf.CatalogUrl,
+		Keyring:         gconf.Keyring,
+		SignaturePolicy: gconf.SignaturePolicy,
+		Mirrors:         gconf.Mirrors,
+		LanSharing:      gconf.LanSharing,
+		Providers:       providers,
+		Client:          client,
+	})
+
+	return r, nil
+}
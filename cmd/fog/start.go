@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// startCmd represents the start command
+var startCmd = &cobra.Command{
+	Use:   "start [machine...]",
+	Short: "Start stopped virtual machines",
+	Long: `Boots the given stopped machines, or all machines with --all, from their existing disks. Images are not
+pulled again.
+
+If the project is running the machines are booted by its process. Otherwise they are booted by a
+background supervisor, like with fog up --detach.`,
+	Example: "fog start web",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := loadProjectConfig()
+
+		if err != nil {
+			return err
+		}
+
+		store, err := openProjectStore(conf)
+
+		if err != nil {
+			return err
+		}
+
+		names, err := machineArgs(cmd, args, conf, store)
+
+		if err != nil {
+			return err
+		}
+
+		return startMachines(cmd.Context(), store, names, store.StartMachine)
+	},
+}
+
+func init() {
+	addAllFlag(startCmd)
+
+	rootCmd.AddCommand(startCmd)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// stopCmd represents the stop command
+var stopCmd = &cobra.Command{
+	Use:   "stop [machine...]",
+	Short: "Stop virtual machines",
+	Long: `Powers off the given machines, or all machines with --all. The machines keep their state, and can be
+booted again with fog start.
+
+Machines which don't power off within their stop_timeout are killed.`,
+	Example: "fog stop web db",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := loadProjectConfig()
+
+		if err != nil {
+			return err
+		}
+
+		store, err := openProjectStore(conf)
+
+		if err != nil {
+			return err
+		}
+
+		names, err := machineArgs(cmd, args, conf, store)
+
+		if err != nil {
+			return err
+		}
+
+		return runMachines(cmd.Context(), names, store.StopMachine)
+	},
+}
+
+func init() {
+	addAllFlag(stopCmd)
+
+	rootCmd.AddCommand(stopCmd)
+}
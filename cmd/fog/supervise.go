@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// superviseCmd represents the supervise command
+var superviseCmd = &cobra.Command{
+	Use:   "supervise [machine...]",
+	Short: "Run a project's machines in the background",
+	Long: `Runs the project's machines, or only the given machines, until it receives SIGTERM or SIGINT.
+It is started by fog up --detach and fog start.`,
+	Hidden: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runProject(cmd.Context(), true, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(superviseCmd)
+}
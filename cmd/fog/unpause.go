@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// unpauseCmd represents the unpause command
+var unpauseCmd = &cobra.Command{
+	Use:     "unpause [machine...]",
+	Short:   "Resume paused virtual machines",
+	Long:    `Resumes the CPUs of the given paused machines, or all machines with --all.`,
+	Example: "fog unpause web",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := loadProjectConfig()
+
+		if err != nil {
+			return err
+		}
+
+		store, err := openProjectStore(conf)
+
+		if err != nil {
+			return err
+		}
+
+		names, err := machineArgs(cmd, args, conf, store)
+
+		if err != nil {
+			return err
+		}
+
+		return runMachines(cmd.Context(), names, store.UnpauseMachine)
+	},
+}
+
+func init() {
+	addAllFlag(unpauseCmd)
+
+	rootCmd.AddCommand(unpauseCmd)
+}
@@ -1,7 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"go.destructure.co/fog"
@@ -13,44 +21,235 @@ var upCmd = &cobra.Command{
 	Short: "Boot virtual machines",
 	Long: `Boots one or more virtual machines according to the fog.yaml specification and any provided arguments.
 	
-If a required base image does not exist locally it will be pulled automatically.`,
+If a required base image does not exist locally it will be pulled automatically.
+
+Press Ctrl+C to power off the machines gracefully. Machines which don't power off within their
+stop_timeout are killed. Press Ctrl+C again to kill the machines immediately.
+
+With --detach the machines are run by a background process, which keeps running after the
+command exits. Its output can be read with fog logs.`,
 	Example: "fog up",
 	Args:    cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		var err error
+		detach, err := cmd.Flags().GetBool("detach")
 
-		conf := &fog.Config{}
+		if err != nil {
+			return err
+		}
 
-		projectConfig.Unmarshal(conf)
+		conf, err := loadProjectConfig()
 
-		for n, m := range conf.Machines {
-			m.CloudConfig = projectConfig.GetStringMap(fmt.Sprintf("machines.%s.cloud_config", n))
+		if err != nil {
+			return err
 		}
 
-		r := fog.NewImageRepository()
-
-		ctx := cmd.Context()
+		store, err := openProjectStore(conf)
 
-		c := fog.NewCluster(conf, r)
+		if err != nil {
+			return err
+		}
 
-		err = c.Init(ctx)
+		proj, err := store.Project()
 
 		if err != nil {
 			return err
 		}
 
-		fmt.Println("Starting machines...")
+		if proj != nil {
+			return fmt.Errorf("project is already running (pid %d)", proj.Pid)
+		}
+
+		if detach {
+			return upDetached(cmd.Context(), nil)
+		}
+
+		return runProject(cmd.Context(), false, nil)
+	},
+}
+
+// runProject boots the project's machines, or only the named machines, and runs them until the context is done.
+func runProject(ctx context.Context, detached bool, names []string) error {
+	conf, err := loadProjectConfig()
+
+	if err != nil {
+		return err
+	}
+
+	r, err := newImageRepository(conf)
+
+	if err != nil {
+		return err
+	}
+
+	store, err := openProjectStore(conf)
+
+	if err != nil {
+		return err
+	}
+
+	proj := &fog.ProjectState{
+		Pid:      os.Getpid(),
+		Detached: detached,
+	}
+
+	if detached {
+		proj.Log = store.LogPath()
+	}
+
+	// Recording the process first keeps two processes from running the project
+	if err := store.SetProject(ctx, proj); err != nil {
+		return err
+	}
+
+	defer store.ClearProject(context.Background())
+
+	c := fog.NewCluster(conf, r, store)
+
+	// Machines are only named when they are started again, so they boot from their existing disks
+	if len(names) > 0 {
+		err = c.InitFromStore(ctx, names...)
+	} else {
+		err = c.Init(ctx)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Starting machines...")
+
+	go func() {
+		select {
+		case <-c.Started():
+		case <-ctx.Done():
+			return
+		}
+
+		proj.Started = time.Now()
+
+		if err := store.SetProject(ctx, proj); err != nil {
+			fmt.Fprintf(os.Stderr, "Recording running machines failed: %s\n", err)
+		}
+	}()
 
-		err = c.Start(ctx)
+	err = c.Start(ctx, names...)
+
+	// A second interrupt while shutting down kills the machines
+	forceCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	defer stop()
+
+	fmt.Println("Stopping machines... (press Ctrl+C again to force)")
+
+	if serr := c.Shutdown(forceCtx); err == nil {
+		err = serr
+	}
+
+	return err
+}
+
+// upDetached starts the project's machines, or only the named machines, in a
+// background supervisor process and waits until they have been started.
+func upDetached(ctx context.Context, names []string) error {
+	conf, err := loadProjectConfig()
+
+	if err != nil {
+		return err
+	}
+
+	r, err := newImageRepository(conf)
+
+	if err != nil {
+		return err
+	}
+
+	store, err := openProjectStore(conf)
+
+	if err != nil {
+		return err
+	}
+
+	// Pulling in the foreground shows the progress of the downloads, while the
+	// supervisor prepares the disks it boots from
+	if err := fog.NewCluster(conf, r, store).PullImages(ctx, names...); err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+
+	if err != nil {
+		return fmt.Errorf("finding fog executable: %w", err)
+	}
+
+	logPath := store.LogPath()
+
+	if err := os.MkdirAll(path.Dir(logPath), 0o755); err != nil {
+		return fmt.Errorf("creating project state directory: %w", err)
+	}
+
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+
+	if err != nil {
+		return fmt.Errorf("opening log file: %w", err)
+	}
+
+	defer logFile.Close()
+
+	fmt.Fprintf(logFile, "--- Starting supervisor at %s\n", time.Now().Format(time.RFC3339))
+
+	sup := exec.Command(exe, append([]string{"supervise"}, names...)...)
+	sup.Stdout = logFile
+	sup.Stderr = logFile
+	// A new session detaches the supervisor from the terminal
+	sup.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := sup.Start(); err != nil {
+		return fmt.Errorf("starting supervisor: %w", err)
+	}
+
+	exited := make(chan error, 1)
+
+	go func() {
+		exited <- sup.Wait()
+	}()
+
+	t := time.NewTicker(100 * time.Millisecond)
+
+	defer t.Stop()
+
+	for {
+		select {
+		case err := <-exited:
+			if err == nil {
+				err = errors.New("exited")
+			}
+
+			return fmt.Errorf("supervisor failed: %w, see fog logs", err)
+		case <-ctx.Done():
+			fmt.Printf("Machines are still starting in the background (pid %d)\n", sup.Process.Pid)
+
+			return nil
+		case <-t.C:
+		}
+
+		proj, err := store.Project()
 
 		if err != nil {
 			return err
 		}
 
-		return nil
-	},
+		if proj != nil && proj.Pid == sup.Process.Pid && !proj.Started.IsZero() {
+			break
+		}
+	}
+
+	fmt.Printf("Started machines in the background (pid %d)\n", sup.Process.Pid)
+
+	return nil
 }
 
 func init() {
+	upCmd.Flags().BoolP("detach", "d", false, "run the machines in the background")
+
 	rootCmd.AddCommand(upCmd)
 }
@@ -0,0 +1,199 @@
+package fog
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// checksumOfDecompressed declares that an image checksum is of the decompressed image.
+const checksumOfDecompressed = "decompressed"
+
+// imageFormat returns the disk format of an image.
+func imageFormat(img *Image) string {
+	if img.Format == "" {
+		return "qcow2"
+	}
+
+	return img.Format
+}
+
+// needsPreparing reports whether a downloaded image must be decompressed or converted before use.
+func needsPreparing(img *Image) bool {
+	return img.Compression != "" || imageFormat(img) != "qcow2"
+}
+
+// prepareImage decompresses a downloaded image and converts it into a qcow2 image at dest.
+// The checksum is verified against the decompressed image if the manifest declares so.
+func prepareImage(ctx context.Context, img *Image, src string, dest string) error {
+	rawPath := dest + ".raw"
+
+	defer os.Remove(rawPath)
+
+	sum, err := decompressFile(src, rawPath, img.Compression)
+
+	if err != nil {
+		return fmt.Errorf("decompressing image: %w", err)
+	}
+
+	if img.ChecksumOf == checksumOfDecompressed && sum != img.Checksum {
+		return fmt.Errorf("checksum %s does not match expected sum %s", sum, img.Checksum)
+	}
+
+	format := imageFormat(img)
+
+	if format == "qcow2" {
+		return os.Rename(rawPath, dest)
+	}
+
+	tmpPath := dest + ".tmp"
+
+	if err := convertImage(ctx, rawPath, format, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, dest)
+}
+
+// decompressFile stream decompresses src into dest and returns the SHA256 checksum of the output.
+func decompressFile(src string, dest string, compression string) (string, error) {
+	in, err := os.Open(src)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer in.Close()
+
+	r, err := decompress(bufio.NewReader(in), compression)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer r.Close()
+
+	out, err := os.Create(dest)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer out.Close()
+
+	h := sha256.New()
+
+	if _, err := io.Copy(io.MultiWriter(out, h), r); err != nil {
+		return "", err
+	}
+
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// decompress wraps a reader with a decompressor for the given compression.
+// Tar archives are read up to the first regular file, which is assumed to be the disk image.
+func decompress(r io.Reader, compression string) (io.ReadCloser, error) {
+	archive := false
+
+	if compression == "tar" || strings.HasPrefix(compression, "tar.") {
+		archive = true
+		compression = strings.TrimPrefix(strings.TrimPrefix(compression, "tar"), ".")
+	}
+
+	var dr io.ReadCloser
+
+	switch compression {
+	case "":
+		dr = io.NopCloser(r)
+	case "gz", "gzip":
+		gr, err := gzip.NewReader(r)
+
+		if err != nil {
+			return nil, err
+		}
+
+		dr = gr
+	case "bz2", "bzip2":
+		dr = io.NopCloser(bzip2.NewReader(r))
+	case "xz":
+		xr, err := xz.NewReader(r)
+
+		if err != nil {
+			return nil, err
+		}
+
+		dr = io.NopCloser(xr)
+	case "zst", "zstd":
+		zr, err := zstd.NewReader(r)
+
+		if err != nil {
+			return nil, err
+		}
+
+		dr = zr.IOReadCloser()
+	default:
+		return nil, fmt.Errorf("unsupported compression '%s'", compression)
+	}
+
+	if !archive {
+		return dr, nil
+	}
+
+	tr := tar.NewReader(dr)
+
+	for {
+		hdr, err := tr.Next()
+
+		if errors.Is(err, io.EOF) {
+			dr.Close()
+			return nil, errors.New("no disk image found in archive")
+		}
+
+		if err != nil {
+			dr.Close()
+			return nil, fmt.Errorf("reading archive: %w", err)
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			return struct {
+				io.Reader
+				io.Closer
+			}{tr, dr}, nil
+		}
+	}
+}
+
+// convertImage converts a disk image into a qcow2 image with qemu-img.
+func convertImage(ctx context.Context, src string, format string, dest string) error {
+	bin, err := exec.LookPath("qemu-img")
+
+	if err != nil {
+		return fmt.Errorf("finding qemu-img binary: %w", err)
+	}
+
+	out, err := exec.CommandContext(ctx, bin, "convert", "-f", format, "-O", "qcow2", src, dest).CombinedOutput()
+
+	if err != nil {
+		return fmt.Errorf("converting image: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
@@ -0,0 +1,244 @@
+package fog
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// testDisk is the content of the disk images used in decompression tests.
+var testDisk = bytes.Repeat([]byte("QFI\xfb disk image "), 1024)
+
+// compressTestData compresses data, wrapped in a tar archive for tar compressions.
+func compressTestData(t *testing.T, compression string, data []byte) []byte {
+	t.Helper()
+
+	if compression == "tar" || strings.HasPrefix(compression, "tar.") {
+		var buf bytes.Buffer
+
+		tw := tar.NewWriter(&buf)
+
+		// Directories before the disk image are skipped
+		if err := tw.WriteHeader(&tar.Header{Name: "disk/", Typeflag: tar.TypeDir, Mode: 0o755}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tw.WriteHeader(&tar.Header{Name: "disk/disk.qcow2", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		data = buf.Bytes()
+		compression = strings.TrimPrefix(strings.TrimPrefix(compression, "tar"), ".")
+	}
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+
+	switch compression {
+	case "":
+		return data
+	case "gz":
+		w = gzip.NewWriter(&buf)
+	case "xz":
+		w, err = xz.NewWriter(&buf)
+	case "zst":
+		w, err = zstd.NewWriter(&buf)
+	default:
+		t.Fatalf("unknown compression %s", compression)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestDecompressFile(t *testing.T) {
+	want := sha256Hex(string(testDisk))
+
+	for _, compression := range []string{"", "gz", "xz", "zst", "tar", "tar.gz", "tar.xz", "tar.zst"} {
+		t.Run("compression="+compression, func(t *testing.T) {
+			dir := t.TempDir()
+			src := path.Join(dir, "disk.download")
+			dest := path.Join(dir, "disk.raw")
+
+			buf := compressTestData(t, compression, testDisk)
+
+			if err := os.WriteFile(src, buf, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			sum, err := decompressFile(src, dest, compression)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if sum != want {
+				t.Fatalf("got checksum %s, want %s", sum, want)
+			}
+
+			out, err := os.ReadFile(dest)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(out, testDisk) {
+				t.Fatal("decompressed image differs")
+			}
+
+			// A truncated raw image can't be detected
+			if compression == "" {
+				return
+			}
+
+			if err := os.WriteFile(src, buf[:len(buf)/2], 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := decompressFile(src, dest, compression); err == nil {
+				t.Fatal("expected truncated stream to fail")
+			}
+		})
+	}
+}
+
+func TestDecompressUnsupported(t *testing.T) {
+	if _, err := decompress(strings.NewReader(""), "rar"); err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Fatalf("expected unsupported compression, got %v", err)
+	}
+
+	if _, err := decompress(bytes.NewReader(compressTestData(t, "gz", testDisk)), "tar.gz"); err == nil {
+		t.Fatal("expected a stream which isn't an archive to fail")
+	}
+}
+
+func TestPullPreparesDownload(t *testing.T) {
+	xzDisk := compressTestData(t, "xz", testDisk)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/disk.qcow2.xz":
+			w.Write(xzDisk)
+		case "/truncated.qcow2.xz":
+			w.Write(xzDisk[:len(xzDisk)/2])
+		default:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		img  *Image
+		// download is an earlier download left in the store
+		download []byte
+		err      string
+	}{
+		{
+			name: "checksum of download",
+			img:  &Image{Url: srv.URL + "/disk.qcow2.xz", Compression: "xz", Checksum: sha256Hex(string(xzDisk))},
+		},
+		{
+			name: "checksum of decompressed image",
+			img:  &Image{Url: srv.URL + "/disk.qcow2.xz", Compression: "xz", Checksum: sha256Hex(string(testDisk)), ChecksumOf: checksumOfDecompressed},
+		},
+		{
+			name:     "earlier download",
+			img:      &Image{Url: srv.URL + "/unavailable", Compression: "xz", Checksum: sha256Hex(string(xzDisk))},
+			download: xzDisk,
+		},
+		{
+			name: "truncated download",
+			img:  &Image{Url: srv.URL + "/truncated.qcow2.xz", Compression: "xz", Checksum: sha256Hex(string(testDisk)), ChecksumOf: checksumOfDecompressed},
+			err:  "preparing image",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRepository(t, RepositoryOptions{})
+
+			tt.img.Name = "test"
+			dest := r.ImagePath(tt.img)
+
+			if tt.download != nil {
+				if err := os.MkdirAll(path.Dir(dest), 0o755); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := os.WriteFile(dest+".download", tt.download, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := r.Pull(context.Background(), tt.img, ImagePullOptions{Download: DownloadOptions{Retries: -1}})
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+
+				if _, err := os.Stat(dest); err == nil {
+					t.Fatal("image was stored despite the failure")
+				}
+
+				// The unverified download may be corrupt, so it isn't kept
+				if _, err := os.Stat(dest + ".download"); err == nil {
+					t.Fatal("unverified download was kept")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := os.ReadFile(dest)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(out, testDisk) {
+				t.Fatal("prepared image differs")
+			}
+
+			if _, err := os.Stat(dest + ".download"); err == nil {
+				t.Fatal("download was kept after preparing the image")
+			}
+		})
+	}
+}
@@ -1,9 +1,42 @@
 package fog
 
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// defaultStopTimeout is how long machines get to power off by default
+const defaultStopTimeout = 30 * time.Second
+
+// GlobalConfig defines the user wide configuration.
+type GlobalConfig struct {
+	// CatalogUrl is the location of the remote image catalog index
+	CatalogUrl string `yaml:"catalog_url" mapstructure:"catalog_url"`
+	// Keyring is the directory of trusted public keys for image signatures
+	Keyring string
+	// SignaturePolicy is the image signature policy: require, warn or off
+	SignaturePolicy string `yaml:"signature_policy" mapstructure:"signature_policy"`
+	// Mirrors rewrite image URLs to mirrors, which are tried in order before the original URL
+	Mirrors []Mirror
+	// Proxy configures the HTTP proxy used for downloads
+	Proxy ProxyConfig
+	// CaBundle is a PEM file of additional certificate authorities to trust for downloads
+	CaBundle string `yaml:"ca_bundle" mapstructure:"ca_bundle"`
+	// LanSharing shares cached images with fog instances on the local network
+	LanSharing bool `yaml:"lan_sharing" mapstructure:"lan_sharing"`
+	// Providers are additional image sources, consulted in order for images without a manifest
+	Providers []ProviderConfig
+}
+
 // Config defines the configuration for a project.
 type Config struct {
+	// Name identifies the project's state, which is identified by the project directory by default
+	Name string
 	// Machines maps machine names to definitions
 	Machines map[string]*MachineConfig
+	// Images defines project specific image manifests
+	Images []*Image
 }
 
 // MachineConfig represents the configuration for a virtual machine in a fog project.
@@ -14,6 +47,153 @@ type MachineConfig struct {
 	Ports []string
 	// Memory sets the VM startup RAM size
 	Memory string
+	// Arch sets the guest architecture, the host architecture by default
+	Arch string
 	// CloudConfig defines cloud-config YAML for cloud-init
 	CloudConfig map[string]interface{} `yaml:"cloud_config"`
+	// Persistent keeps changes to the disk in an overlay in the project state directory
+	// instead of discarding them when the machine stops
+	Persistent bool
+	// DiskSize is the size the root disk is grown to before boot, such as 20G
+	DiskSize string `yaml:"disk_size" mapstructure:"disk_size"`
+	// Disks are additional data disks attached to the machine
+	Disks []*DiskConfig
+	// Cpus is the number of virtual CPUs, 1 by default
+	Cpus int
+	// CpuModel is the QEMU CPU model, host when accelerated and an emulated model otherwise
+	CpuModel string `yaml:"cpu_model" mapstructure:"cpu_model"`
+	// Topology divides the virtual CPUs into sockets, cores and threads
+	Topology *CpuTopology
+	// Accel overrides the accelerator: kvm, hvf or tcg
+	Accel string
+	// StopTimeout is how long to wait for the machine to power off before killing it, 30s by default
+	StopTimeout string `yaml:"stop_timeout" mapstructure:"stop_timeout"`
+}
+
+// CpuTopology represents the SMP topology of a machine. Unset values default to 1.
+type CpuTopology struct {
+	Sockets int
+	Cores   int
+	Threads int
+}
+
+// DiskConfig represents an additional data disk of a machine.
+type DiskConfig struct {
+	// Name identifies the disk and is used as its serial number in the guest
+	Name string
+	// Size is the size of the disk, such as 10G
+	Size string
+	// Format is the disk format, qcow2 (default) or raw
+	Format string
+	// Interface is the disk controller: virtio-blk (default), virtio-scsi or nvme
+	Interface string
+	// Cache is the QEMU cache mode, such as none, writeback or unsafe
+	Cache string
+	// Persistent keeps the disk's data when the machine stops
+	Persistent bool
+}
+
+// validate checks the machine config for invalid settings.
+func (c *MachineConfig) validate() error {
+	if _, err := profileForArch(c.MachineArch()); err != nil {
+		return err
+	}
+
+	if c.Cpus < 0 {
+		return fmt.Errorf("invalid number of cpus %d", c.Cpus)
+	}
+
+	if t := c.Topology; t != nil {
+		if t.Sockets < 0 || t.Cores < 0 || t.Threads < 0 {
+			return errors.New("topology values must not be negative")
+		}
+
+		if n := max1(t.Sockets) * max1(t.Cores) * max1(t.Threads); c.Cpus != 0 && c.Cpus != n {
+			return fmt.Errorf("cpus %d does not match the %d CPUs of the topology", c.Cpus, n)
+		}
+	}
+
+	switch c.Accel {
+	case "", accelTcg:
+	case accelKvm, accelHvf:
+		if c.MachineArch() != HostArch() {
+			return fmt.Errorf("accelerator %s requires the host architecture %s, not %s", c.Accel, HostArch(), c.MachineArch())
+		}
+	default:
+		return fmt.Errorf("unsupported accelerator '%s'", c.Accel)
+	}
+
+	if c.CpuModel == "host" && c.Accel == accelTcg {
+		return errors.New("cpu_model host requires hardware acceleration")
+	}
+
+	if c.StopTimeout != "" {
+		if d, err := time.ParseDuration(c.StopTimeout); err != nil || d < 0 {
+			return fmt.Errorf("invalid stop_timeout '%s'", c.StopTimeout)
+		}
+	}
+
+	if c.DiskSize != "" {
+		if _, err := parseSize(c.DiskSize); err != nil {
+			return fmt.Errorf("invalid disk_size: %w", err)
+		}
+	}
+
+	names := make(map[string]bool)
+
+	for _, d := range c.Disks {
+		if !diskNamePattern.MatchString(d.Name) {
+			return fmt.Errorf("invalid disk name '%s'", d.Name)
+		}
+
+		if names[d.Name] {
+			return fmt.Errorf("duplicate disk name '%s'", d.Name)
+		}
+
+		names[d.Name] = true
+
+		if _, err := parseSize(d.Size); err != nil {
+			return fmt.Errorf("disk %s: invalid size: %w", d.Name, err)
+		}
+
+		switch d.Format {
+		case "", "qcow2", "raw":
+		default:
+			return fmt.Errorf("disk %s: unsupported format '%s'", d.Name, d.Format)
+		}
+
+		switch d.Interface {
+		case "", diskVirtioBlk, diskVirtioScsi, diskNvme:
+		default:
+			return fmt.Errorf("disk %s: unsupported interface '%s'", d.Name, d.Interface)
+		}
+
+		switch d.Cache {
+		case "", "none", "writeback", "writethrough", "directsync", "unsafe":
+		default:
+			return fmt.Errorf("disk %s: unsupported cache mode '%s'", d.Name, d.Cache)
+		}
+	}
+
+	return nil
+}
+
+// stopTimeout returns how long to wait for the machine to power off.
+func (c *MachineConfig) stopTimeout() time.Duration {
+	d, err := time.ParseDuration(c.StopTimeout)
+
+	if err != nil {
+		return defaultStopTimeout
+	}
+
+	return d
+}
+
+// MachineArch returns the guest architecture of a machine.
+func (c *MachineConfig) MachineArch() string {
+	if c.Arch == "" {
+		return HostArch()
+	}
+
+	return normalizeArch(c.Arch)
 }
@@ -0,0 +1,137 @@
+package fog
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMachineConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		conf *MachineConfig
+		err  string
+	}{
+		{
+			name: "defaults",
+			conf: &MachineConfig{},
+		},
+		{
+			name: "full config",
+			conf: &MachineConfig{
+				Arch:        "arm64",
+				Cpus:        4,
+				Topology:    &CpuTopology{Sockets: 2, Cores: 2},
+				Accel:       accelTcg,
+				CpuModel:    "cortex-a72",
+				StopTimeout: "1m",
+				DiskSize:    "20G",
+				Disks: []*DiskConfig{
+					{Name: "data", Size: "10G", Format: "raw", Interface: diskVirtioScsi, Cache: "writeback"},
+					{Name: "fast_1", Size: "1G", Interface: diskNvme, Persistent: true},
+				},
+			},
+		},
+		{
+			name: "topology sets cpus",
+			conf: &MachineConfig{Topology: &CpuTopology{Cores: 2, Threads: 2}},
+		},
+		{
+			name: "unsupported arch",
+			conf: &MachineConfig{Arch: "sparc"},
+			err:  "unsupported architecture 'sparc'",
+		},
+		{
+			name: "negative cpus",
+			conf: &MachineConfig{Cpus: -1},
+			err:  "invalid number of cpus -1",
+		},
+		{
+			name: "negative topology",
+			conf: &MachineConfig{Topology: &CpuTopology{Cores: -2}},
+			err:  "topology values must not be negative",
+		},
+		{
+			name: "cpus don't match topology",
+			conf: &MachineConfig{Cpus: 4, Topology: &CpuTopology{Sockets: 2, Cores: 3}},
+			err:  "cpus 4 does not match the 6 CPUs of the topology",
+		},
+		{
+			name: "unsupported accelerator",
+			conf: &MachineConfig{Accel: "xen"},
+			err:  "unsupported accelerator 'xen'",
+		},
+		{
+			name: "accelerator of foreign arch",
+			conf: &MachineConfig{Arch: foreignArch, Accel: accelKvm},
+			err:  "accelerator kvm requires the host architecture",
+		},
+		{
+			name: "host cpu with tcg",
+			conf: &MachineConfig{Accel: accelTcg, CpuModel: "host"},
+			err:  "cpu_model host requires hardware acceleration",
+		},
+		{
+			name: "invalid stop timeout",
+			conf: &MachineConfig{StopTimeout: "soon"},
+			err:  "invalid stop_timeout 'soon'",
+		},
+		{
+			name: "negative stop timeout",
+			conf: &MachineConfig{StopTimeout: "-1s"},
+			err:  "invalid stop_timeout '-1s'",
+		},
+		{
+			name: "invalid disk size",
+			conf: &MachineConfig{DiskSize: "big"},
+			err:  "invalid disk_size",
+		},
+		{
+			name: "invalid disk name",
+			conf: &MachineConfig{Disks: []*DiskConfig{{Name: "my disk", Size: "1G"}}},
+			err:  "invalid disk name 'my disk'",
+		},
+		{
+			name: "duplicate disk name",
+			conf: &MachineConfig{Disks: []*DiskConfig{{Name: "data", Size: "1G"}, {Name: "data", Size: "2G"}}},
+			err:  "duplicate disk name 'data'",
+		},
+		{
+			name: "missing disk size",
+			conf: &MachineConfig{Disks: []*DiskConfig{{Name: "data"}}},
+			err:  "disk data: invalid size",
+		},
+		{
+			name: "unsupported disk format",
+			conf: &MachineConfig{Disks: []*DiskConfig{{Name: "data", Size: "1G", Format: "vmdk"}}},
+			err:  "disk data: unsupported format 'vmdk'",
+		},
+		{
+			name: "unsupported disk interface",
+			conf: &MachineConfig{Disks: []*DiskConfig{{Name: "data", Size: "1G", Interface: "ide"}}},
+			err:  "disk data: unsupported interface 'ide'",
+		},
+		{
+			name: "unsupported cache mode",
+			conf: &MachineConfig{Disks: []*DiskConfig{{Name: "data", Size: "1G", Cache: "fast"}}},
+			err:  "disk data: unsupported cache mode 'fast'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.conf.validate()
+
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,472 @@
+package fog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// Results of machine lifecycle operations.
+const (
+	ResultNotRunning     = "not running"
+	ResultAlreadyRunning = "already running"
+	ResultPoweredOff     = "powered off"
+	ResultKilled         = "killed"
+	ResultStarted        = "started"
+	ResultRestarted      = "restarted"
+	ResultPaused         = "paused"
+	ResultUnpaused       = "unpaused"
+)
+
+// ErrProjectNotRunning is returned when a machine can't be booted because no
+// fog process is running the project.
+var ErrProjectNotRunning = errors.New("project is not running")
+
+// processPollInterval is how often a process is checked while waiting for it to exit.
+const processPollInterval = 100 * time.Millisecond
+
+// StopMachine shuts down a machine recorded in the store, which may be run by
+// another fog process, and returns how it was stopped.
+//
+// The machine is asked to power off over QMP and killed if it doesn't power
+// off within its stop timeout. It is killed immediately when the context is done.
+func (s *ProjectStore) StopMachine(ctx context.Context, name string) (string, error) {
+	st, err := s.Machine(name)
+
+	if err != nil || st == nil {
+		return ResultNotRunning, err
+	}
+
+	err = s.UpdateMachine(ctx, name, func(cur *MachineState) error {
+		st = cur
+
+		// The process running the machine records it as stopped once it exits
+		if cur.Status == MachineRunning {
+			cur.Status = MachineStopping
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	if st.Status != MachineStopping {
+		return ResultNotRunning, nil
+	}
+
+	timeout := st.StopTimeout
+
+	if timeout == 0 {
+		timeout = defaultStopTimeout
+	}
+
+	m := machineFromState(st)
+
+	pctx, cancel := context.WithTimeout(ctx, qmpTimeout)
+
+	// A paused guest can't handle the power off request
+	err = m.Resume(pctx)
+
+	if err == nil {
+		err = m.Powerdown(pctx)
+	}
+
+	cancel()
+
+	result := ResultPoweredOff
+
+	if err != nil {
+		log.Warn("Powering off machine failed, killing it", "machine", name, "error", err)
+
+		result = ResultKilled
+	} else if err := waitProcess(ctx, st.Pid, st.PidStart, timeout); err != nil {
+		log.Warn("Machine did not power off in time, killing it", "machine", name, "timeout", timeout)
+
+		result = ResultKilled
+	}
+
+	if result == ResultKilled {
+		if err := killProcess(st.Pid, st.PidStart); err != nil {
+			return "", fmt.Errorf("killing machine %s: %w", name, err)
+		}
+	}
+
+	err = s.UpdateMachine(context.Background(), name, func(st *MachineState) error {
+		st.Pid = 0
+		st.PidStart = 0
+		st.Status = MachineStopped
+
+		return nil
+	})
+
+	return result, err
+}
+
+// PauseMachine pauses the CPUs of a running machine recorded in the store.
+func (s *ProjectStore) PauseMachine(ctx context.Context, name string) (string, error) {
+	return s.qmpMachine(ctx, name, ResultPaused, (*Machine).Pause)
+}
+
+// UnpauseMachine resumes a paused machine recorded in the store.
+func (s *ProjectStore) UnpauseMachine(ctx context.Context, name string) (string, error) {
+	return s.qmpMachine(ctx, name, ResultUnpaused, (*Machine).Resume)
+}
+
+// qmpMachine runs a QMP command on a running machine recorded in the store.
+func (s *ProjectStore) qmpMachine(ctx context.Context, name string, result string, do func(m *Machine, ctx context.Context) error) (string, error) {
+	st, err := s.Machine(name)
+
+	if err != nil {
+		return "", err
+	}
+
+	if st == nil || st.Status != MachineRunning {
+		return ResultNotRunning, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, qmpTimeout)
+
+	defer cancel()
+
+	if err := do(machineFromState(st), ctx); err != nil {
+		return "", fmt.Errorf("machine %s: %w", name, err)
+	}
+
+	return result, nil
+}
+
+// StartMachine asks the fog process running the project to boot a stopped
+// machine again. Persistent disks are kept, and the image isn't pulled again.
+// It returns ErrProjectNotRunning if no process is running the project.
+func (s *ProjectStore) StartMachine(ctx context.Context, name string) (string, error) {
+	return s.control(ctx, name, "start")
+}
+
+// RestartMachine asks the fog process running the project to power off a
+// machine and boot it again. Stopped machines are booted.
+// It returns ErrProjectNotRunning if no process is running the project.
+func (s *ProjectStore) RestartMachine(ctx context.Context, name string) (string, error) {
+	return s.control(ctx, name, "restart")
+}
+
+// control sends a request for a machine to the control socket of the process running the project.
+func (s *ProjectStore) control(ctx context.Context, name string, action string) (string, error) {
+	proj, err := s.Project()
+
+	if err != nil {
+		return "", err
+	}
+
+	if proj == nil {
+		return "", ErrProjectNotRunning
+	}
+
+	if proj.Started.IsZero() {
+		return "", fmt.Errorf("project is still starting (pid %d)", proj.Pid)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+
+				return d.DialContext(ctx, "unix", s.controlPath())
+			},
+		},
+	}
+
+	u := "http://fog/machines/" + url.PathEscape(name) + "/" + action
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	res, err := client.Do(req)
+
+	if err != nil {
+		return "", fmt.Errorf("contacting project process: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+
+	if err != nil {
+		return "", fmt.Errorf("reading response of project process: %w", err)
+	}
+
+	msg := strings.TrimSpace(string(body))
+
+	if res.StatusCode != http.StatusOK {
+		return "", errors.New(msg)
+	}
+
+	return msg, nil
+}
+
+// controlPath returns the path of the control socket of the process running the project.
+func (s *ProjectStore) controlPath() string {
+	return path.Join(s.runtimeDir, "control.sock")
+}
+
+// listenControl opens the control socket, which other fog processes use to
+// boot the cluster's machines.
+func (c *Cluster) listenControl() (net.Listener, error) {
+	p := c.store.controlPath()
+
+	if err := os.MkdirAll(path.Dir(p), 0o755); err != nil {
+		return nil, fmt.Errorf("creating runtime directory: %w", err)
+	}
+
+	// A socket left behind by a process which didn't exit cleanly
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("removing stale control socket: %w", err)
+	}
+
+	l, err := net.Listen("unix", p)
+
+	if err != nil {
+		return nil, fmt.Errorf("opening control socket: %w", err)
+	}
+
+	return l, nil
+}
+
+// controlHandler handles requests to the control socket.
+func (c *Cluster) controlHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/machines/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/machines/"), "/")
+
+		m := c.machine(name)
+
+		if m == nil {
+			http.Error(w, fmt.Sprintf("machine %s not found", name), http.StatusNotFound)
+			return
+		}
+
+		var result string
+		var err error
+
+		switch action {
+		case "start":
+			result, err = c.bootMachine(r.Context(), m)
+		case "restart":
+			result, err = c.rebootMachine(r.Context(), m)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprintln(w, result)
+	})
+
+	return mux
+}
+
+// bootMachine boots a stopped machine of the cluster.
+func (c *Cluster) bootMachine(ctx context.Context, m *Machine) (string, error) {
+	if err := c.startMachine(ctx, m); errors.Is(err, errAlreadyRunning) {
+		return ResultAlreadyRunning, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return ResultStarted, nil
+}
+
+// rebootMachine powers off a machine of the cluster and boots it again.
+func (c *Cluster) rebootMachine(ctx context.Context, m *Machine) (string, error) {
+	if !m.running() {
+		return c.bootMachine(ctx, m)
+	}
+
+	// Counting the machine as running keeps Start from returning while it is down.
+	// Once the cluster is shut down, Shutdown stops the machine instead.
+	c.mu.Lock()
+
+	if c.closing {
+		c.mu.Unlock()
+
+		return "", errShuttingDown
+	}
+
+	c.running++
+	c.mu.Unlock()
+
+	defer c.release()
+
+	if err := m.Stop(ctx, m.Conf.stopTimeout()); err != nil {
+		return "", err
+	}
+
+	// Another request may have started the machine again, which counts as a restart
+	if err := c.startMachine(ctx, m); err != nil && !errors.Is(err, errAlreadyRunning) {
+		return "", err
+	}
+
+	return ResultRestarted, nil
+}
+
+// RunState queries the run state of a running machine over QMP.
+func (st *MachineState) RunState(ctx context.Context) (*MachineStatus, error) {
+	if st.Status != MachineRunning {
+		return nil, fmt.Errorf("machine %s is not running", st.Name)
+	}
+
+	return machineFromState(st).Status(ctx)
+}
+
+// StopProject stops the process running the project's machines, which powers
+// off any machines still running, and waits for it to exit.
+// It returns false if the project wasn't running.
+func (s *ProjectStore) StopProject(ctx context.Context) (bool, error) {
+	proj, err := s.Project()
+
+	if err != nil || proj == nil {
+		return false, err
+	}
+
+	if err := syscall.Kill(proj.Pid, syscall.SIGTERM); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return false, fmt.Errorf("stopping project process: %w", err)
+	}
+
+	for processAlive(proj.Pid) {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(processPollInterval):
+		}
+	}
+
+	return true, nil
+}
+
+// RemoveMachine removes the state of a stopped machine, including its persistent disks.
+// The machine gets a new ID when it is booted again.
+//
+// It fails while a process is running the project, since that process records
+// the exits of its machines and boots them from the disks it prepared.
+func (s *ProjectStore) RemoveMachine(ctx context.Context, name string) (bool, error) {
+	// Holding the lock keeps a process from starting the project in the meantime
+	unlock, err := lockFile(ctx, path.Join(s.runtimeDir, "project.lock"))
+
+	if err != nil {
+		return false, err
+	}
+
+	defer unlock()
+
+	proj, err := s.Project()
+
+	if err != nil {
+		return false, err
+	}
+
+	if proj != nil {
+		return false, fmt.Errorf("project is still running (pid %d)", proj.Pid)
+	}
+
+	st, err := s.Machine(name)
+
+	if err != nil {
+		return false, err
+	}
+
+	if st != nil && (st.Status == MachineRunning || st.Status == MachineStopping) {
+		return false, fmt.Errorf("machine %s is still running", name)
+	}
+
+	dir := s.machineDir(name)
+
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return false, fmt.Errorf("removing state of machine %s: %w", name, err)
+	}
+
+	if err := os.Remove(s.machineRuntimePath(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("removing runtime state of machine %s: %w", name, err)
+	}
+
+	return true, nil
+}
+
+// machineFromState returns a machine to control a machine recorded in the store.
+func machineFromState(st *MachineState) *Machine {
+	return &Machine{
+		ID:      st.ID,
+		Name:    st.Name,
+		addr:    st.Socket,
+		qmpAddr: st.QmpSocket,
+	}
+}
+
+// waitProcess waits for a process which started at the given time to exit,
+// until the timeout or the context is done.
+func waitProcess(ctx context.Context, pid int, started uint64, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+
+	defer cancel()
+
+	for processRunning(pid, started) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(processPollInterval):
+		}
+	}
+
+	return nil
+}
+
+// killProcess kills a process which started at the given time and waits for it to exit.
+// The PID may have been reused by another process, so it refuses to kill any
+// process it can't confirm to be the one which started at that time.
+func killProcess(pid int, started uint64) error {
+	same, err := sameProcess(pid, started)
+
+	if err != nil {
+		return fmt.Errorf("refusing to kill process %d: %w", pid, err)
+	}
+
+	if !same {
+		return nil
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return err
+	}
+
+	// The process is gone once its parent has reaped it
+	return waitProcess(context.Background(), pid, started, 5*time.Second)
+}
@@ -0,0 +1,245 @@
+package fog
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adrg/xdg"
+)
+
+// newTestCluster returns a cluster serving its control socket, whose machines
+// run a fake QEMU which sleeps instead of booting.
+func newTestCluster(t *testing.T, names ...string) *Cluster {
+	t.Helper()
+
+	prof, err := profileForArch(HostArch())
+
+	if err != nil || len(prof.firmware) > 0 || len(prof.kernel) > 0 {
+		t.Skip("machines of the host architecture need firmware")
+	}
+
+	bin := t.TempDir()
+
+	if err := os.WriteFile(path.Join(bin, prof.binary), []byte("#!/bin/sh\nexec sleep 60\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	// Reloaded once the runtime directory is restored
+	t.Cleanup(xdg.Reload)
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	xdg.Reload()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	t.Cleanup(cancel)
+
+	conf := &Config{Machines: make(map[string]*MachineConfig)}
+
+	c := NewCluster(conf, nil, newTestStore(t))
+	c.opts = &StartOptions{output: io.Discard}
+	c.mux = NewLogMux(ctx, io.Discard)
+
+	for _, n := range names {
+		// The fake QEMU can't be powered off, so it is killed right away
+		conf.Machines[n] = &MachineConfig{StopTimeout: "10ms"}
+
+		m := NewMachine(n, conf.Machines[n], &Image{Name: "test"}, os.DevNull)
+		m.prepared = true
+
+		c.machines = append(c.machines, m)
+	}
+
+	l, err := c.listenControl()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.controlSrv = &http.Server{Handler: c.controlHandler()}
+
+	go c.controlSrv.Serve(l)
+
+	t.Cleanup(func() { c.Shutdown(context.Background()) })
+
+	if err := c.store.SetProject(ctx, &ProjectState{Pid: os.Getpid(), Started: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// controlConcurrently runs the same request for a machine several times at once and returns the results.
+func controlConcurrently(t *testing.T, do func(ctx context.Context, name string) (string, error), name string, n int) []string {
+	t.Helper()
+
+	results := make([]string, n)
+	errs := make([]error, n)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		i := i
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			results[i], errs[i] = do(context.Background(), name)
+		}()
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return results
+}
+
+func TestControlStartRestart(t *testing.T) {
+	c := newTestCluster(t, "one", "two")
+	s := c.store
+
+	started := 0
+
+	for _, res := range controlConcurrently(t, s.StartMachine, "one", 3) {
+		switch res {
+		case ResultStarted:
+			started++
+		case ResultAlreadyRunning:
+		default:
+			t.Fatalf("unexpected result %q", res)
+		}
+	}
+
+	if started != 1 {
+		t.Fatalf("machine was started %d times", started)
+	}
+
+	pid := c.machine("one").lastRun().cmd.Process.Pid
+
+	for _, res := range controlConcurrently(t, s.RestartMachine, "one", 3) {
+		if res != ResultRestarted {
+			t.Fatalf("unexpected result %q", res)
+		}
+	}
+
+	m := c.machine("one")
+
+	if !m.running() || m.lastRun().cmd.Process.Pid == pid {
+		t.Fatal("machine wasn't restarted")
+	}
+
+	// A stopped machine is booted by a restart
+	if res, err := s.RestartMachine(context.Background(), "two"); err != nil || res != ResultStarted {
+		t.Fatalf("unexpected result %q, %v", res, err)
+	}
+
+	// Restarts racing with the shutdown either finish first or are refused
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		s.RestartMachine(context.Background(), "one")
+	}()
+
+	if err := c.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	wg.Wait()
+
+	for _, m := range c.machines {
+		if m.running() {
+			t.Fatalf("machine %s is still running", m.Name)
+		}
+
+		st, err := s.Machine(m.Name)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if st.Status != MachineStopped {
+			t.Fatalf("machine %s has status %s, want stopped", m.Name, st.Status)
+		}
+	}
+}
+
+func TestStartWhilePulling(t *testing.T) {
+	requested := make(chan struct{})
+	unblock := make(chan struct{})
+
+	var once sync.Once
+
+	release := func() { once.Do(func() { close(unblock) }) }
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requested)
+		<-unblock
+
+		w.Write([]byte("disk"))
+	}))
+
+	t.Cleanup(srv.Close)
+
+	c := newTestCluster(t, "one", "slow")
+	c.r = newTestRepository(t, RepositoryOptions{})
+
+	// The pull is finished before the cluster is shut down if the test fails
+	t.Cleanup(release)
+
+	// The image of the slow machine hasn't been pulled yet
+	m := c.machine("slow")
+	m.Img = &Image{Name: "slow", Url: srv.URL + "/disk.qcow2", Checksum: sha256Hex("disk")}
+	m.prepared = false
+
+	slow := make(chan error, 1)
+
+	go func() {
+		slow <- c.startMachine(context.Background(), m)
+	}()
+
+	<-requested
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	// Neither other machines nor the shutdown wait for the pull
+	if res, err := c.store.StartMachine(ctx, "one"); err != nil || res != ResultStarted {
+		t.Fatalf("unexpected result %q, %v", res, err)
+	}
+
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	release()
+
+	// The machine isn't booted once the cluster has been shut down
+	if err := <-slow; !errors.Is(err, errShuttingDown) {
+		t.Fatalf("expected the start to be refused, got %v", err)
+	}
+
+	if m.running() {
+		t.Fatal("machine was started after the shutdown")
+	}
+}
@@ -0,0 +1,142 @@
+package fog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	accelKvm = "kvm"
+	accelHvf = "hvf"
+	accelTcg = "tcg"
+)
+
+var (
+	hostAccelOnce sync.Once
+	hostAccelName string
+	hostAccelErr  error
+)
+
+// hostAccel returns the hardware accelerator of the host, or an error explaining why none is available.
+// The result is cached.
+func hostAccel() (string, error) {
+	hostAccelOnce.Do(func() {
+		hostAccelName, hostAccelErr = detectAccel()
+	})
+
+	return hostAccelName, hostAccelErr
+}
+
+// detectAccel detects the hardware accelerator of the host.
+func detectAccel() (string, error) {
+	switch runtime.GOOS {
+	case "linux":
+		f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+
+		if errors.Is(err, os.ErrNotExist) {
+			return "", errors.New("/dev/kvm does not exist, KVM may be disabled or unsupported")
+		}
+
+		if errors.Is(err, os.ErrPermission) {
+			return "", errors.New("no permission to access /dev/kvm, add your user to the kvm group")
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("opening /dev/kvm: %w", err)
+		}
+
+		f.Close()
+
+		return accelKvm, nil
+	case "darwin":
+		out, err := exec.Command("sysctl", "-n", "kern.hv_support").Output()
+
+		if err != nil || strings.TrimSpace(string(out)) != "1" {
+			return "", errors.New("the Hypervisor framework is not supported")
+		}
+
+		return accelHvf, nil
+	default:
+		return "", fmt.Errorf("hardware acceleration is not supported on %s", runtime.GOOS)
+	}
+}
+
+// machineCpu selects the accelerator and CPU model of a machine.
+//
+// Unless overridden, hardware acceleration is used when the guest matches the
+// host and the host supports it. Otherwise the guest is emulated with a CPU
+// model which is safe to use with TCG.
+func machineCpu(name string, conf *MachineConfig, prof *archProfile) (string, string, error) {
+	arch := conf.MachineArch()
+
+	accel := conf.Accel
+
+	if accel == "" {
+		accel = accelTcg
+
+		if arch == HostArch() {
+			if a, err := hostAccel(); err == nil {
+				accel = a
+			} else {
+				log.Warn("Hardware acceleration is not available, emulating the machine instead", "machine", name, "reason", err)
+			}
+		}
+	} else if accel != accelTcg {
+		if a, err := hostAccel(); err != nil {
+			return "", "", fmt.Errorf("accelerator %s is not available: %w", accel, err)
+		} else if a != accel {
+			return "", "", fmt.Errorf("accelerator %s is not available on this host, use %s or tcg", accel, a)
+		}
+	}
+
+	cpu := conf.CpuModel
+
+	if cpu == "" {
+		cpu = prof.tcgCpu
+
+		if accel != accelTcg {
+			cpu = "host"
+		}
+	}
+
+	if cpu == "host" && accel == accelTcg {
+		return "", "", errors.New("cpu_model host requires hardware acceleration")
+	}
+
+	return accel, cpu, nil
+}
+
+// smpArg returns the QEMU -smp argument of a machine.
+func smpArg(conf *MachineConfig) string {
+	t := conf.Topology
+
+	if t == nil {
+		cpus := conf.Cpus
+
+		if cpus == 0 {
+			cpus = 1
+		}
+
+		return fmt.Sprintf("cpus=%d", cpus)
+	}
+
+	sockets, cores, threads := max1(t.Sockets), max1(t.Cores), max1(t.Threads)
+
+	return fmt.Sprintf("cpus=%d,sockets=%d,cores=%d,threads=%d", sockets*cores*threads, sockets, cores, threads)
+}
+
+// max1 returns n, or 1 if n is not set.
+func max1(n int) int {
+	if n < 1 {
+		return 1
+	}
+
+	return n
+}
@@ -0,0 +1,154 @@
+package fog
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// foreignArch is a guest architecture which never matches the host.
+const foreignArch = "riscv64"
+
+// setHostAccel replaces the detected hardware accelerator of the host for the duration of a test.
+func setHostAccel(t *testing.T, accel string, err error) {
+	t.Helper()
+
+	// Detect first, so the replacement isn't overwritten by a later detection
+	name, detectErr := hostAccel()
+
+	hostAccelName, hostAccelErr = accel, err
+
+	t.Cleanup(func() {
+		hostAccelName, hostAccelErr = name, detectErr
+	})
+}
+
+func TestMachineCpu(t *testing.T) {
+	unavailable := errors.New("/dev/kvm does not exist")
+
+	tests := []struct {
+		name      string
+		conf      *MachineConfig
+		hostAccel string
+		hostErr   error
+		accel     string
+		cpu       string
+		err       string
+	}{
+		{
+			name:      "host arch accelerated",
+			conf:      &MachineConfig{},
+			hostAccel: accelKvm,
+			accel:     accelKvm,
+			cpu:       "host",
+		},
+		{
+			name:    "host arch falls back to tcg",
+			conf:    &MachineConfig{},
+			hostErr: unavailable,
+			accel:   accelTcg,
+			cpu:     "max",
+		},
+		{
+			name:      "foreign arch is emulated",
+			conf:      &MachineConfig{Arch: foreignArch},
+			hostAccel: accelKvm,
+			accel:     accelTcg,
+			cpu:       "rv64",
+		},
+		{
+			name:      "tcg override",
+			conf:      &MachineConfig{Accel: accelTcg},
+			hostAccel: accelKvm,
+			accel:     accelTcg,
+			cpu:       "max",
+		},
+		{
+			name:      "cpu model override",
+			conf:      &MachineConfig{CpuModel: "Skylake-Client"},
+			hostAccel: accelKvm,
+			accel:     accelKvm,
+			cpu:       "Skylake-Client",
+		},
+		{
+			name:      "hvf override",
+			conf:      &MachineConfig{Accel: accelHvf},
+			hostAccel: accelHvf,
+			accel:     accelHvf,
+			cpu:       "host",
+		},
+		{
+			name:    "unavailable accelerator",
+			conf:    &MachineConfig{Accel: accelKvm},
+			hostErr: unavailable,
+			err:     "accelerator kvm is not available: /dev/kvm does not exist",
+		},
+		{
+			name:      "accelerator of another host",
+			conf:      &MachineConfig{Accel: accelKvm},
+			hostAccel: accelHvf,
+			err:       "use hvf or tcg",
+		},
+		{
+			name:    "host cpu without acceleration",
+			conf:    &MachineConfig{CpuModel: "host"},
+			hostErr: unavailable,
+			err:     "cpu_model host requires hardware acceleration",
+		},
+		{
+			name:      "host cpu of foreign arch",
+			conf:      &MachineConfig{Arch: foreignArch, CpuModel: "host"},
+			hostAccel: accelKvm,
+			err:       "cpu_model host requires hardware acceleration",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setHostAccel(t, tt.hostAccel, tt.hostErr)
+
+			prof, err := profileForArch(tt.conf.MachineArch())
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			accel, cpu, err := machineCpu("test", tt.conf, prof)
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if accel != tt.accel || cpu != tt.cpu {
+				t.Fatalf("got accel %s and cpu %s, want %s and %s", accel, cpu, tt.accel, tt.cpu)
+			}
+		})
+	}
+}
+
+func TestSmpArg(t *testing.T) {
+	tests := []struct {
+		conf *MachineConfig
+		want string
+	}{
+		{conf: &MachineConfig{}, want: "cpus=1"},
+		{conf: &MachineConfig{Cpus: 4}, want: "cpus=4"},
+		{conf: &MachineConfig{Topology: &CpuTopology{}}, want: "cpus=1,sockets=1,cores=1,threads=1"},
+		{conf: &MachineConfig{Topology: &CpuTopology{Cores: 4}}, want: "cpus=4,sockets=1,cores=4,threads=1"},
+		{conf: &MachineConfig{Cpus: 8, Topology: &CpuTopology{Sockets: 2, Cores: 2, Threads: 2}}, want: "cpus=8,sockets=2,cores=2,threads=2"},
+	}
+
+	for _, tt := range tests {
+		if got := smpArg(tt.conf); got != tt.want {
+			t.Errorf("smpArg(%+v) = %s, want %s", *tt.conf, got, tt.want)
+		}
+	}
+}
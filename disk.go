@@ -0,0 +1,339 @@
+package fog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/adrg/xdg"
+	"github.com/charmbracelet/log"
+)
+
+const (
+	diskVirtioBlk  = "virtio-blk"
+	diskVirtioScsi = "virtio-scsi"
+	diskNvme       = "nvme"
+)
+
+// diskNamePattern matches valid data disk names.
+var diskNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,20}$`)
+
+// machineDisk is a disk attached to a machine.
+type machineDisk struct {
+	// id identifies the disk's drive
+	id string
+	// serial is the serial number of the disk in the guest
+	serial string
+	path   string
+	format string
+	iface  string
+	cache  string
+	// snapshot discards writes to the disk when the machine stops
+	snapshot bool
+}
+
+// driveArgs returns the QEMU arguments attaching disks to a machine.
+// The first disk is the boot disk.
+func driveArgs(disks []*machineDisk) []string {
+	var args []string
+
+	scsi := false
+
+	for i, d := range disks {
+		drive := fmt.Sprintf("file=%s,if=none,id=%s,format=%s", d.path, d.id, d.format)
+
+		if d.cache != "" {
+			drive += ",cache=" + d.cache
+		}
+
+		if d.snapshot {
+			drive += ",snapshot=on"
+		}
+
+		var device string
+
+		switch d.iface {
+		case diskVirtioScsi:
+			if !scsi {
+				args = append(args, "-device", "virtio-scsi-pci,id=scsi0")
+				scsi = true
+			}
+
+			device = "scsi-hd,drive=" + d.id + ",bus=scsi0.0"
+		case diskNvme:
+			// NVMe controllers require a serial number
+			serial := d.serial
+
+			if serial == "" {
+				serial = d.id
+			}
+
+			device = "nvme,drive=" + d.id + ",serial=" + serial
+		default:
+			device = "virtio-blk-pci,drive=" + d.id
+		}
+
+		if d.serial != "" && d.iface != diskNvme {
+			device += ",serial=" + d.serial
+		}
+
+		if i == 0 {
+			device += ",bootindex=0"
+		}
+
+		args = append(args, "-drive", drive, "-device", device)
+	}
+
+	return args
+}
+
+// persistentDisk returns the persistent overlay disk of a machine, creating it if it doesn't exist yet.
+//
+// The overlay keeps using the image it was created from when the machine's
+// image changes, as rebasing it would break the guest's filesystem. The
+// checksum of the backing image is recorded next to the disk.
+func (c *Cluster) persistentDisk(ctx context.Context, name string, img *Image) (string, error) {
+	dir := c.store.machineDir(name)
+	disk := path.Join(dir, "disk.qcow2")
+	backingFile := path.Join(dir, "image")
+
+	if _, err := os.Stat(disk); err == nil {
+		buf, err := os.ReadFile(backingFile)
+
+		if err != nil {
+			return "", fmt.Errorf("reading backing image of disk: %w", err)
+		}
+
+		if sum := strings.TrimSpace(string(buf)); sum != img.Checksum {
+			log.Warn("Machine image changed, keeping the existing disk", "machine", name, "disk", sum, "image", img.Checksum)
+		}
+
+		return disk, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("creating machine state directory: %w", err)
+	}
+
+	if err := os.WriteFile(backingFile, []byte(img.Checksum+"\n"), 0o644); err != nil {
+		return "", fmt.Errorf("recording backing image of disk: %w", err)
+	}
+
+	if err := createOverlay(ctx, c.r.ImagePath(img), disk); err != nil {
+		return "", err
+	}
+
+	log.Debug("Created persistent disk", "machine", name, "disk", disk)
+
+	return disk, nil
+}
+
+// scratchDisk recreates the temporary overlay disk of a machine, which is used
+// when the root disk is resized without keeping its changes.
+func (c *Cluster) scratchDisk(ctx context.Context, name string, img *Image) (string, error) {
+	dir := c.store.machineDir(name)
+	disk := path.Join(dir, "scratch.qcow2")
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("creating machine state directory: %w", err)
+	}
+
+	if err := os.Remove(disk); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("removing scratch disk: %w", err)
+	}
+
+	if err := createOverlay(ctx, c.r.ImagePath(img), disk); err != nil {
+		return "", err
+	}
+
+	return disk, nil
+}
+
+// dataDisks creates the data disks of a machine which don't exist yet.
+//
+// Disks which aren't persistent are recreated on every boot, and their
+// writes are discarded. Persistent disks are grown if their size increased.
+func (c *Cluster) dataDisks(ctx context.Context, name string, conf *MachineConfig) ([]*machineDisk, error) {
+	dir := path.Join(c.store.machineDir(name), "disks")
+
+	if len(conf.Disks) > 0 {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("creating disk directory: %w", err)
+		}
+	}
+
+	var disks []*machineDisk
+
+	for _, dc := range conf.Disks {
+		format := dc.Format
+
+		if format == "" {
+			format = "qcow2"
+		}
+
+		d := &machineDisk{
+			id:       "disk-" + dc.Name,
+			serial:   dc.Name,
+			path:     path.Join(dir, dc.Name+"."+format),
+			format:   format,
+			iface:    dc.Interface,
+			cache:    dc.Cache,
+			snapshot: !dc.Persistent,
+		}
+
+		if !dc.Persistent {
+			d.path = path.Join(dir, dc.Name+".scratch."+format)
+
+			if err := os.Remove(d.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("removing scratch disk %s: %w", dc.Name, err)
+			}
+		}
+
+		if _, err := os.Stat(d.path); err == nil {
+			if err := resizeDisk(ctx, d.path, dc.Size); err != nil {
+				return nil, fmt.Errorf("disk %s: %w", dc.Name, err)
+			}
+		} else if err := createDisk(ctx, d.path, format, dc.Size); err != nil {
+			return nil, fmt.Errorf("disk %s: %w", dc.Name, err)
+		}
+
+		disks = append(disks, d)
+	}
+
+	return disks, nil
+}
+
+// createDisk creates an empty disk.
+func createDisk(ctx context.Context, dest string, format string, size string) error {
+	bytes, err := parseSize(size)
+
+	if err != nil {
+		return err
+	}
+
+	out, err := qemuImg(ctx, "create", "-f", format, dest, strconv.FormatInt(bytes, 10))
+
+	if err != nil {
+		return fmt.Errorf("creating disk: %w: %s", err, out)
+	}
+
+	return nil
+}
+
+// resizeDisk grows a disk to a size. Disks are never shrunk, as that would
+// truncate the guest's filesystems.
+func resizeDisk(ctx context.Context, disk string, size string) error {
+	bytes, err := parseSize(size)
+
+	if err != nil {
+		return err
+	}
+
+	out, err := qemuImg(ctx, "info", "--output=json", disk)
+
+	if err != nil {
+		return fmt.Errorf("reading disk info: %w: %s", err, out)
+	}
+
+	info := struct {
+		Format      string `json:"format"`
+		VirtualSize int64  `json:"virtual-size"`
+	}{}
+
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		return fmt.Errorf("parsing disk info: %w", err)
+	}
+
+	if bytes == info.VirtualSize {
+		return nil
+	}
+
+	if bytes < info.VirtualSize {
+		log.Warn("Disks can't be shrunk, keeping the current size", "disk", disk, "size", info.VirtualSize)
+
+		return nil
+	}
+
+	out, err = qemuImg(ctx, "resize", "-f", info.Format, disk, strconv.FormatInt(bytes, 10))
+
+	if err != nil {
+		return fmt.Errorf("resizing disk: %w: %s", err, out)
+	}
+
+	log.Debug("Resized disk", "disk", disk, "size", bytes)
+
+	return nil
+}
+
+// qemuImg runs qemu-img and returns its combined output.
+func qemuImg(ctx context.Context, args ...string) (string, error) {
+	bin, err := exec.LookPath("qemu-img")
+
+	if err != nil {
+		return "", fmt.Errorf("finding qemu-img binary: %w", err)
+	}
+
+	out, err := exec.CommandContext(ctx, bin, args...).CombinedOutput()
+
+	return strings.TrimSpace(string(out)), err
+}
+
+// parseSize parses a size such as 512M, 20G or 1TiB into bytes.
+// Units are powers of 1024 like in QEMU, and a size without a unit is in bytes.
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "IB"), "B")
+
+	mult := int64(1)
+
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGT", s[n-1]); i >= 0 {
+			mult = 1 << (10 * (i + 1))
+			s = s[:n-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+
+	if err != nil || n <= 0 {
+		return 0, errors.New("size must be a positive number with an optional K, M, G or T unit")
+	}
+
+	return n * mult, nil
+}
+
+// diskBackingImages returns the checksums of the images backing the persistent disks of all projects.
+func diskBackingImages() (map[string]bool, error) {
+	sums := make(map[string]bool)
+
+	files, err := filepath.Glob(path.Join(xdg.StateHome, "fog", "projects", "*", "machines", "*", "image"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		buf, err := os.ReadFile(f)
+
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("reading backing image of disk: %w", err)
+		}
+
+		sums[strings.TrimSpace(string(buf))] = true
+	}
+
+	return sums, nil
+}
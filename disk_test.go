@@ -0,0 +1,130 @@
+package fog
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDriveArgs(t *testing.T) {
+	root := &machineDisk{id: "root", path: "/images/root.qcow2", format: "qcow2", iface: diskVirtioBlk, snapshot: true}
+
+	tests := []struct {
+		name  string
+		disks []*machineDisk
+		want  []string
+	}{
+		{
+			name:  "boot disk",
+			disks: []*machineDisk{root},
+			want: []string{
+				"-drive", "file=/images/root.qcow2,if=none,id=root,format=qcow2,snapshot=on",
+				"-device", "virtio-blk-pci,drive=root,bootindex=0",
+			},
+		},
+		{
+			name: "virtio-blk data disk",
+			disks: []*machineDisk{root, {
+				id: "disk-data", serial: "data", path: "/disks/data.qcow2", format: "qcow2", iface: diskVirtioBlk, cache: "writeback",
+			}},
+			want: []string{
+				"-drive", "file=/images/root.qcow2,if=none,id=root,format=qcow2,snapshot=on",
+				"-device", "virtio-blk-pci,drive=root,bootindex=0",
+				"-drive", "file=/disks/data.qcow2,if=none,id=disk-data,format=qcow2,cache=writeback",
+				"-device", "virtio-blk-pci,drive=disk-data,serial=data",
+			},
+		},
+		{
+			name: "virtio-scsi disks share a controller",
+			disks: []*machineDisk{root, {
+				id: "disk-a", serial: "a", path: "/disks/a.raw", format: "raw", iface: diskVirtioScsi,
+			}, {
+				id: "disk-b", serial: "b", path: "/disks/b.scratch.qcow2", format: "qcow2", iface: diskVirtioScsi, snapshot: true,
+			}},
+			want: []string{
+				"-drive", "file=/images/root.qcow2,if=none,id=root,format=qcow2,snapshot=on",
+				"-device", "virtio-blk-pci,drive=root,bootindex=0",
+				"-device", "virtio-scsi-pci,id=scsi0",
+				"-drive", "file=/disks/a.raw,if=none,id=disk-a,format=raw",
+				"-device", "scsi-hd,drive=disk-a,bus=scsi0.0,serial=a",
+				"-drive", "file=/disks/b.scratch.qcow2,if=none,id=disk-b,format=qcow2,snapshot=on",
+				"-device", "scsi-hd,drive=disk-b,bus=scsi0.0,serial=b",
+			},
+		},
+		{
+			name: "nvme disks",
+			disks: []*machineDisk{root, {
+				id: "disk-fast", serial: "fast", path: "/disks/fast.qcow2", format: "qcow2", iface: diskNvme,
+			}, {
+				id: "disk-noserial", path: "/disks/noserial.qcow2", format: "qcow2", iface: diskNvme,
+			}},
+			want: []string{
+				"-drive", "file=/images/root.qcow2,if=none,id=root,format=qcow2,snapshot=on",
+				"-device", "virtio-blk-pci,drive=root,bootindex=0",
+				"-drive", "file=/disks/fast.qcow2,if=none,id=disk-fast,format=qcow2",
+				"-device", "nvme,drive=disk-fast,serial=fast",
+				"-drive", "file=/disks/noserial.qcow2,if=none,id=disk-noserial,format=qcow2",
+				"-device", "nvme,drive=disk-noserial,serial=disk-noserial",
+			},
+		},
+		{
+			name: "persistent nvme boot disk",
+			disks: []*machineDisk{{
+				id: "root", path: "/state/disk.qcow2", format: "qcow2", iface: diskNvme,
+			}},
+			want: []string{
+				"-drive", "file=/state/disk.qcow2,if=none,id=root,format=qcow2",
+				"-device", "nvme,drive=root,serial=root,bootindex=0",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := driveArgs(tt.disks); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size string
+		want int64
+		err  bool
+	}{
+		{size: "1048576", want: 1 << 20},
+		{size: "512K", want: 512 << 10},
+		{size: "256M", want: 256 << 20},
+		{size: "10G", want: 10 << 30},
+		{size: "2T", want: 2 << 40},
+		{size: "10g", want: 10 << 30},
+		{size: "10GB", want: 10 << 30},
+		{size: "10GiB", want: 10 << 30},
+		{size: " 4G ", want: 4 << 30},
+		{size: "100B", want: 100},
+		{size: "", err: true},
+		{size: "G", err: true},
+		{size: "0", err: true},
+		{size: "-1G", err: true},
+		{size: "1.5G", err: true},
+		{size: "10P", err: true},
+		{size: "ten", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSize(tt.size)
+
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseSize(%q) = %d, want an error", tt.size, got)
+			}
+
+			continue
+		}
+
+		if err != nil || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", tt.size, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package fog
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+const (
+	// defaultRetries is the number of times a failed download is retried by default
+	defaultRetries = 5
+	// retryBaseDelay is the delay before the first retry, doubled for each following retry
+	retryBaseDelay = time.Second
+	// retryMaxDelay caps the delay between retries
+	retryMaxDelay = 30 * time.Second
+)
+
+// DownloadOptions configures a file download.
+type DownloadOptions struct {
+	// Retries is the number of times a transient error is retried.
+	// Zero uses the default and a negative value disables retries.
+	Retries int
+	// RemovePartial removes the partially downloaded file on failure.
+	// By default it is kept so a later download can resume it.
+	RemovePartial bool
+	// header is sent with every request, such as registry authorization
+	header http.Header
+	// verify is called with the path of the completed download before it is accepted
+	verify func(string) error
+	// client is the HTTP client used for the download, http.DefaultClient by default
+	client *http.Client
+}
+
+// httpStatusError is returned when a server responds with an unexpected status.
+type httpStatusError struct {
+	url    string
+	status string
+	code   int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("downloading %s: HTTP error %s", e.url, e.status)
+}
+
+// networkError is an error sending a request or reading a response.
+type networkError struct {
+	err error
+}
+
+func (e *networkError) Error() string {
+	return e.err.Error()
+}
+
+func (e *networkError) Unwrap() error {
+	return e.err
+}
+
+// networkReader marks errors reading a response body as network errors.
+type networkReader struct {
+	r io.Reader
+}
+
+func (r networkReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+
+	if err != nil && err != io.EOF {
+		err = &networkError{err: err}
+	}
+
+	return n, err
+}
+
+// transient reports whether a download error may succeed if retried.
+// Only server errors and network failures are retried, not local failures such as a full disk.
+func transient(err error) bool {
+	var statusErr *httpStatusError
+
+	if errors.As(err, &statusErr) {
+		return statusErr.code >= 500 || statusErr.code == http.StatusTooManyRequests || statusErr.code == http.StatusRequestTimeout
+	}
+
+	var netErr *networkError
+
+	if !errors.As(err, &netErr) {
+		return false
+	}
+
+	var dnsErr *net.DNSError
+
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false
+	}
+
+	var certErr *tls.CertificateVerificationError
+
+	if errors.As(err, &certErr) {
+		return false
+	}
+
+	// Anything else is a network level failure such as a dropped connection
+	return true
+}
+
+// DownloadFile downloads a URL to a file and verifies its SHA256 checksum.
+// Verification is skipped if the checksum is empty.
+//
+// The download is written to a .tmp file next to the destination. An existing
+// .tmp file is resumed with an HTTP range request and transient errors are
+// retried with exponential backoff.
+func DownloadFile(ctx context.Context, filepath string, url string, checksum string, opts DownloadOptions) error {
+	tmpPath := filepath + ".tmp"
+
+	retries := opts.Retries
+
+	client := opts.client
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	if retries == 0 {
+		retries = defaultRetries
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := downloadAttempt(ctx, client, tmpPath, url, opts.header)
+
+		if err == nil {
+			break
+		}
+
+		if ctx.Err() != nil || !transient(err) || attempt >= retries {
+			if opts.RemovePartial {
+				os.Remove(tmpPath)
+			}
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return err
+		}
+
+		delay := retryBaseDelay << attempt
+
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+
+		log.Warn("Download failed, retrying", "url", url, "error", err, "delay", delay)
+
+		select {
+		case <-ctx.Done():
+			if opts.RemovePartial {
+				os.Remove(tmpPath)
+			}
+
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	if checksum != "" {
+		sum, err := fileChecksum(tmpPath)
+
+		if err != nil {
+			return fmt.Errorf("verify checksum: %w", err)
+		}
+
+		if sum != checksum {
+			// The file is corrupt, so there is nothing worth resuming
+			os.Remove(tmpPath)
+
+			return fmt.Errorf("checksum %s does not match expected sum %s", sum, checksum)
+		}
+	}
+
+	if opts.verify != nil {
+		if err := opts.verify(tmpPath); err != nil {
+			os.Remove(tmpPath)
+
+			return err
+		}
+	}
+
+	if err := os.Rename(tmpPath, filepath); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// downloadAttempt downloads a URL to a file, resuming from the end of the file if it exists.
+func downloadAttempt(ctx context.Context, client *http.Client, filepath string, url string, header http.Header) error {
+	tmpFile, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	defer tmpFile.Close()
+
+	fi, err := tmpFile.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	offset := fi.Size()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return &networkError{err: err}
+	}
+
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		log.Debug("Resuming download", "url", url, "offset", offset)
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The file is already complete, the checksum will tell if it is valid
+		return nil
+	case resp.StatusCode == http.StatusOK:
+		// The server ignored the range request so start from scratch
+		offset = 0
+	default:
+		return &httpStatusError{url: url, status: resp.Status, code: resp.StatusCode}
+	}
+
+	if err := tmpFile.Truncate(offset); err != nil {
+		return err
+	}
+
+	if _, err := tmpFile.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	byteSize := resp.ContentLength
+
+	if byteSize >= 0 {
+		byteSize += offset
+	}
+
+	prefix := "Downloading image"
+
+	onComplete := prefix + ": done"
+
+	// TODO: accept io writer for mpb output
+
+	p := mpb.NewWithContext(ctx,
+		mpb.WithWidth(80),
+		mpb.WithRefreshRate(180*time.Millisecond),
+	)
+
+	bar := p.AddBar(byteSize,
+		mpb.BarFillerClearOnComplete(),
+		mpb.PrependDecorators(
+			decor.OnComplete(decor.Name(prefix), onComplete),
+		),
+		mpb.AppendDecorators(
+			decor.OnComplete(decor.CountersKibiByte("%.1f / %.1f"), ""),
+		),
+	)
+
+	bar.SetCurrent(offset)
+
+	proxyReader := bar.ProxyReader(networkReader{r: resp.Body})
+
+	defer proxyReader.Close()
+
+	if _, err := io.Copy(tmpFile, proxyReader); err != nil {
+		bar.Abort(false)
+		p.Wait()
+
+		return err
+	}
+
+	if byteSize < 0 {
+		bar.SetTotal(-1, true)
+	}
+
+	p.Wait()
+
+	return tmpFile.Close()
+}
+
+// fileChecksum returns the hex encoded SHA256 checksum of a file.
+func fileChecksum(filepath string) (string, error) {
+	f, err := os.Open(filepath)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,90 @@
+package fog
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDownloadFileResumes(t *testing.T) {
+	content := strings.Repeat("fog image data ", 64*1024)
+
+	var mu sync.Mutex
+	var ranges []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		first := len(ranges) == 1
+		mu.Unlock()
+
+		if !first {
+			http.ServeContent(w, r, "image.qcow2", time.Time{}, strings.NewReader(content))
+			return
+		}
+
+		// Drop the connection halfway through the body
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Write([]byte(content[:len(content)/2]))
+		w.(http.Flusher).Flush()
+
+		panic(http.ErrAbortHandler)
+	}))
+
+	defer srv.Close()
+
+	dest := path.Join(t.TempDir(), "image.qcow2")
+
+	err := DownloadFile(context.Background(), dest, srv.URL+"/image.qcow2", sha256Hex(content), DownloadOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := os.ReadFile(dest)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != content {
+		t.Fatal("downloaded file does not match")
+	}
+
+	if len(ranges) != 2 {
+		t.Fatalf("got %d requests, want 2", len(ranges))
+	}
+
+	if want := fmt.Sprintf("bytes=%d-", len(content)/2); ranges[1] != want {
+		t.Fatalf("resumed with range %q, want %q", ranges[1], want)
+	}
+}
+
+func TestTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"server error", &httpStatusError{code: http.StatusBadGateway}, true},
+		{"not found", &httpStatusError{code: http.StatusNotFound}, false},
+		{"dropped connection", &networkError{err: syscall.ECONNRESET}, true},
+		{"full disk", &fs.PathError{Op: "write", Path: "image.tmp", Err: syscall.ENOSPC}, false},
+		{"permission denied", &fs.PathError{Op: "open", Path: "image.tmp", Err: syscall.EACCES}, false},
+	}
+
+	for _, tt := range tests {
+		if got := transient(tt.err); got != tt.want {
+			t.Errorf("%s: transient = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
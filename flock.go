@@ -0,0 +1,58 @@
+package fog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+// lockPollInterval is how often a held file lock is retried.
+const lockPollInterval = 100 * time.Millisecond
+
+// lockFile takes an exclusive advisory lock on a file, creating it if required.
+//
+// If another process holds the lock it is retried until the context is done.
+// The returned function releases the lock.
+func lockFile(ctx context.Context, filepath string) (func() error, error) {
+	if err := os.MkdirAll(path.Dir(filepath), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("creating lock directory: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath, os.O_RDWR|os.O_CREATE, 0644)
+
+	if err != nil {
+		return nil, fmt.Errorf("opening lock file: %w", err)
+	}
+
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("locking %s: %w", filepath, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+
+	unlock := func() error {
+		defer f.Close()
+
+		return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	}
+
+	return unlock, nil
+}
@@ -3,22 +3,26 @@ module go.destructure.co/fog
 go 1.20
 
 require (
+	github.com/ProtonMail/go-crypto v1.1.6
 	github.com/charmbracelet/lipgloss v0.7.1
 	github.com/charmbracelet/log v0.2.2
 	github.com/hashicorp/mdns v1.0.5
+	github.com/klauspost/compress v1.16.5
 	github.com/lucasb-eyer/go-colorful v1.2.0
+	github.com/ulikunitz/xz v0.5.11
 	github.com/vbauerster/mpb/v8 v8.4.0
-	golang.org/x/crypto v0.9.0
+	golang.org/x/crypto v0.17.0
+	golang.org/x/net v0.10.0
 )
 
 require (
 	github.com/aymanbagabas/go-osc52/v2 v2.0.1 // indirect
+	github.com/cloudflare/circl v1.3.7 // indirect
 	github.com/go-logfmt/logfmt v0.6.0 // indirect
 	github.com/mattn/go-isatty v0.0.18 // indirect
 	github.com/miekg/dns v1.1.41 // indirect
 	github.com/muesli/reflow v0.3.0 // indirect
 	github.com/muesli/termenv v0.15.1 // indirect
-	golang.org/x/net v0.10.0 // indirect
 )
 
 require (
@@ -41,8 +45,8 @@ require (
 	github.com/spf13/viper v1.16.0
 	github.com/subosito/gotenv v1.4.2 // indirect
 	golang.org/x/sync v0.2.0
-	golang.org/x/sys v0.8.0 // indirect
-	golang.org/x/text v0.9.0 // indirect
+	golang.org/x/sys v0.16.0
+	golang.org/x/text v0.14.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1
 )
@@ -2,22 +2,17 @@ package fog
 
 import (
 	"context"
-	"crypto/sha256"
 	"embed"
-	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
 	"io/fs"
 	"net/http"
 	"os"
 	"path"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/adrg/xdg"
-	"github.com/vbauerster/mpb/v8"
-	"github.com/vbauerster/mpb/v8/decor"
 	"gopkg.in/yaml.v3"
 )
 
@@ -29,15 +24,56 @@ var manifests embed.FS
 // Image defines a virtual machine image.
 type Image struct {
 	Name     string
-	Url      string
+	Url      string `yaml:",omitempty"`
 	Checksum string
 	Arch     string
 	Tags     []string
-	Username string
+	Username string `yaml:",omitempty"`
+	// Upstream resolves the URL and checksum from vendor metadata when set
+	Upstream *Upstream `yaml:",omitempty"`
+	// Compression is the compression of the download, such as xz, gz, zst or tar.gz
+	Compression string `yaml:",omitempty"`
+	// Format is the disk format of the image, qcow2 by default
+	Format string `yaml:",omitempty"`
+	// ChecksumOf declares whether the checksum is of the "compressed" download (default) or the "decompressed" image
+	ChecksumOf string `yaml:"checksum_of,omitempty" mapstructure:"checksum_of"`
+	// Build defines how to build the image from a base image with fog build
+	Build *ImageBuild `yaml:",omitempty"`
+	// Signature verifies the image against a vendor signature when set
+	Signature *ImageSignature `yaml:",omitempty"`
+	// FallbackUrls are other locations of the image, tried in order if the URL fails
+	FallbackUrls []string `yaml:"fallback_urls,omitempty" mapstructure:"fallback_urls"`
+	// builtin is set for manifests embedded in the binary
+	builtin bool
+	// provider is the configured provider the image was resolved from
+	provider ImageProvider
 }
 
 type ImagePullOptions struct {
-	//
+	// Download configures retries and partial file handling of the image download
+	Download DownloadOptions
+}
+
+// RepositoryOptions configures the manifest sources of an ImageRepository.
+type RepositoryOptions struct {
+	// ProjectDir is the root directory of the current project, if any
+	ProjectDir string
+	// Images are manifests defined in the project config
+	Images []*Image
+	// CatalogUrl is the location of the remote image catalog index
+	CatalogUrl string
+	// Keyring is the directory of trusted public keys for image signatures
+	Keyring string
+	// SignaturePolicy is the image signature policy: require, warn (default) or off
+	SignaturePolicy string
+	// Mirrors rewrite image URLs to mirrors, which are tried before the original URL
+	Mirrors []Mirror
+	// LanSharing fetches images from fog instances on the local network before downloading them
+	LanSharing bool
+	// Providers are additional image sources, consulted in order for images without a manifest
+	Providers []ImageProvider
+	// Client is the HTTP client used for downloads, http.DefaultClient by default
+	Client *http.Client
 }
 
 type ImageRepository struct {
@@ -45,81 +81,291 @@ type ImageRepository struct {
 	dataDir string
 	// dataFs is a filesystem containing the image data
 	dataFs fs.FS
+	// manifestDirs are directories containing manifests, in order of increasing precedence
+	manifestDirs []string
+	// projectImgs are manifests from the project config, which take precedence over all others
+	projectImgs []*Image
+	// catalogUrl is the location of the remote image catalog index
+	catalogUrl string
+	// keyring is the directory of trusted public keys
+	keyring string
+	// signaturePolicy decides how image signatures are enforced
+	signaturePolicy string
+	// mirrors rewrite image URLs to mirrors
+	mirrors []Mirror
+	// lanSharing fetches images from peers on the local network first
+	lanSharing bool
+	// providers are additional image sources, in order of decreasing precedence
+	providers []ImageProvider
+	// client is the HTTP client used for all requests
+	client *http.Client
+	// lockPath is the file recording resolved upstream image builds
+	lockPath string
+	lockMu   sync.Mutex
+	// imgs holds the loaded manifests, in order of decreasing precedence
 	imgs   []*Image
 	pullMu sync.Mutex
 	// pulls tracks the image SHAs we are currently pulling
-	pulls map[string]int
+	pulls map[string]*pullCall
 }
 
-func NewImageRepository() *ImageRepository {
+func NewImageRepository(opts RepositoryOptions) *ImageRepository {
 	dataDir := path.Join(xdg.DataHome, "fog")
 
 	dataFs := os.DirFS(dataDir)
 
+	manifestDirs := []string{
+		path.Join(xdg.ConfigHome, "fog", "images"),
+	}
+
+	lockPath := path.Join(dataDir, "images.lock")
+
+	client := opts.Client
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	keyring := opts.Keyring
+
+	if keyring == "" {
+		keyring = path.Join(xdg.ConfigHome, "fog", "keyring")
+	}
+
+	if opts.ProjectDir != "" {
+		manifestDirs = append(manifestDirs, path.Join(opts.ProjectDir, ".fog", "images"))
+		lockPath = path.Join(opts.ProjectDir, "fog.lock")
+	}
+
 	r := &ImageRepository{
-		dataDir: dataDir,
-		dataFs:  dataFs,
+		dataDir:         dataDir,
+		dataFs:          dataFs,
+		manifestDirs:    manifestDirs,
+		projectImgs:     opts.Images,
+		catalogUrl:      opts.CatalogUrl,
+		lockPath:        lockPath,
+		keyring:         keyring,
+		signaturePolicy: opts.SignaturePolicy,
+		lanSharing:      opts.LanSharing,
+		providers:       opts.Providers,
+		mirrors:         opts.Mirrors,
+		client:          client,
+		pulls:           make(map[string]*pullCall),
 	}
 
 	return r
 }
 
+// LoadManifests loads the image manifests from all sources.
+//
+// Manifests from the project config override those in the project's .fog/images
+// directory, which override those in the user's config directory, which override
+// the downloaded remote catalog, which in turn overrides the built-in manifests.
 func (r *ImageRepository) LoadManifests() error {
-	imgs, err := loadManifests()
+	imgs, err := loadManifests(manifests)
 
 	if err != nil {
-		return fmt.Errorf("loading image manifests: %w", err)
+		return fmt.Errorf("loading built-in image manifests: %w", err)
+	}
+
+	for _, img := range imgs {
+		img.builtin = true
+	}
+
+	catImgs, err := r.loadCatalog()
+
+	if err != nil {
+		return err
+	}
+
+	imgs = append(catImgs, imgs...)
+
+	for _, dir := range r.manifestDirs {
+		if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		dirImgs, err := loadManifests(os.DirFS(dir))
+
+		if err != nil {
+			return fmt.Errorf("loading image manifests from %s: %w", dir, err)
+		}
+
+		imgs = append(dirImgs, imgs...)
 	}
 
-	r.imgs = imgs
+	r.imgs = append(append([]*Image{}, r.projectImgs...), imgs...)
 
 	return nil
 }
 
-func (r *ImageRepository) Find(ctx context.Context, rawImage string) (*Image, error) {
+// Find returns the image matching a name and optional tag for an architecture.
+// An empty architecture matches images of any architecture.
+//
+// Images with upstream metadata are resolved to the build recorded in the lock
+// file, or to the newest upstream build if none is recorded yet.
+func (r *ImageRepository) Find(ctx context.Context, rawImage string, arch string) (*Image, error) {
+	return r.find(ctx, rawImage, arch, false)
+}
+
+// Refresh is like Find but always resolves images with upstream metadata to the newest build.
+func (r *ImageRepository) Refresh(ctx context.Context, rawImage string, arch string) (*Image, error) {
+	return r.find(ctx, rawImage, arch, true)
+}
+
+func (r *ImageRepository) find(ctx context.Context, rawImage string, arch string, refresh bool) (*Image, error) {
+	arch = normalizeArch(arch)
+
+	if strings.HasPrefix(rawImage, ociScheme) {
+		if arch == "" {
+			arch = HostArch()
+		}
+
+		return resolveOci(ctx, r.client, rawImage, arch)
+	}
+
 	name, tag, err := ParseImageName(rawImage)
 
 	if err != nil {
 		return &Image{}, fmt.Errorf("parsing image name: %w", err)
 	}
 
+	img, err := r.resolveManifest(ctx, name, tag, arch, refresh)
+
+	if errors.Is(err, ErrImageNotFound) {
+		img, err = r.resolveProviders(ctx, name, tag, arch)
+	}
+
+	if errors.Is(err, ErrImageNotFound) && arch != "" {
+		return &Image{}, fmt.Errorf("image %s:%s not found for architecture %s", name, tag, arch)
+	}
+
+	if errors.Is(err, ErrImageNotFound) {
+		return &Image{}, fmt.Errorf("Image not found")
+	}
+
+	if err != nil {
+		return &Image{}, err
+	}
+
+	return img, nil
+}
+
+// resolveManifest returns the image matching a name and tag for an architecture from the loaded manifests.
+func (r *ImageRepository) resolveManifest(ctx context.Context, name string, tag string, arch string, refresh bool) (*Image, error) {
+	var unbuilt *Image
+
 	for _, img := range r.imgs {
 		if img.Name != name {
 			continue
 		}
 
+		// Manifests without an architecture are assumed to support any
+		if arch != "" && img.Arch != "" && normalizeArch(img.Arch) != arch {
+			continue
+		}
+
 		for _, t := range img.Tags {
-			if t == tag {
-				return img, nil
+			if t != tag {
+				continue
 			}
+
+			// Built images are registered as separate manifests with lower precedence
+			if img.Build != nil && img.Checksum == "" {
+				unbuilt = img
+				continue
+			}
+
+			if img.Upstream != nil {
+				return r.resolve(ctx, img, tag, refresh)
+			}
+
+			return img, nil
 		}
 	}
 
-	return &Image{}, fmt.Errorf("Image not found")
+	if unbuilt != nil {
+		return nil, fmt.Errorf("image %s:%s has not been built yet, run fog build", name, tag)
+	}
+
+	return nil, ErrImageNotFound
 }
 
 func (r *ImageRepository) ImagePath(img *Image) string {
 	return path.Join(r.dataDir, "images", img.Checksum+".qcow2")
 }
 
+// pullCall is an in progress image pull.
+type pullCall struct {
+	// done is closed when the pull finishes
+	done chan struct{}
+	err  error
+}
+
+// Pull downloads an image into the image store.
+//
+// Concurrent pulls of the same image are coalesced, with later callers waiting
+// for the result of the first. A file lock prevents other fog processes from
+// downloading the same image at the same time.
 func (r *ImageRepository) Pull(ctx context.Context, img *Image, opts ImagePullOptions) error {
-	r.pullMu.Lock()
+	// Images without a checksum can't be told apart, so their pulls aren't coalesced
+	if img.Checksum == "" {
+		return r.pull(ctx, img, opts)
+	}
+
+	for {
+		r.pullMu.Lock()
+
+		call, prs := r.pulls[img.Checksum]
+
+		if !prs {
+			break
+		}
 
-	if _, prs := r.pulls[img.Checksum]; prs {
 		r.pullMu.Unlock()
-		return nil
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		// The first caller may have given up, while this caller still wants the image
+		if ctx.Err() == nil && (errors.Is(call.err, context.Canceled) || errors.Is(call.err, context.DeadlineExceeded)) {
+			continue
+		}
+
+		return call.err
 	}
 
+	call := &pullCall{done: make(chan struct{})}
+
+	r.pulls[img.Checksum] = call
+
 	r.pullMu.Unlock()
 
-	defer func() {
-		r.pullMu.Lock()
-		delete(r.pulls, img.Checksum)
-		r.pullMu.Unlock()
-	}()
+	call.err = r.pull(ctx, img, opts)
+
+	r.pullMu.Lock()
+	delete(r.pulls, img.Checksum)
+	r.pullMu.Unlock()
+
+	close(call.done)
+
+	return call.err
+}
 
+func (r *ImageRepository) pull(ctx context.Context, img *Image, opts ImagePullOptions) error {
 	// TODO: move printing to caller
-	fmt.Printf("Trying to pull %s %s...\n", img.Name, img.Checksum[0:8])
+	fmt.Printf("Trying to pull %s %s...\n", img.Name, ShortChecksum(img.Checksum))
+
+	unlock, err := r.lockImage(ctx, img.Checksum)
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
 
 	destFile := r.ImagePath(img)
 
@@ -129,25 +375,94 @@ func (r *ImageRepository) Pull(ctx context.Context, img *Image, opts ImagePullOp
 		return nil
 	}
 
-	err := os.MkdirAll(path.Join(r.dataDir, "images"), os.ModePerm)
+	if img.Url == "" {
+		return fmt.Errorf("image %s has no download URL", img.Name)
+	}
+
+	err = os.MkdirAll(path.Join(r.dataDir, "images"), os.ModePerm)
 
 	if err != nil {
 		return fmt.Errorf("creating image directory: %w", err)
 	}
 
-	err = DownloadFile(destFile, img.Url, img.Checksum)
+	opts.Download.client = r.client
+
+	p := r.providerFor(img)
+
+	// Signatures cover the download, whose checksum is only verified when it's the checksum of the manifest
+	verifiedChecksum := img.Checksum
+
+	if needsPreparing(img) && img.ChecksumOf == checksumOfDecompressed {
+		verifiedChecksum = ""
+	}
+
+	opts.Download.verify, err = r.signatureVerifier(ctx, img, verifiedChecksum)
+
+	if err != nil {
+		return err
+	}
+
+	if !needsPreparing(img) {
+		err = r.fetchImage(ctx, p, img, destFile, img.Checksum, opts.Download)
+
+		if err != nil {
+			return fmt.Errorf("downloading image: %w", err)
+		}
+
+		return nil
+	}
+
+	// The download is kept until the image is prepared so failures don't require downloading it again
+	dlFile := destFile + ".download"
+
+	if _, err := os.Stat(dlFile); err != nil {
+		sum := img.Checksum
+
+		if img.ChecksumOf == checksumOfDecompressed {
+			sum = ""
+		}
+
+		err = r.fetchImage(ctx, p, img, dlFile, sum, opts.Download)
+
+		if err != nil {
+			return fmt.Errorf("downloading image: %w", err)
+		}
+	}
+
+	err = prepareImage(ctx, img, dlFile, destFile)
 
 	if err != nil {
-		return fmt.Errorf("downloading image: %w", err)
+		// An unverified download may be the cause, so don't reuse it
+		if img.ChecksumOf == checksumOfDecompressed {
+			os.Remove(dlFile)
+		}
+
+		return fmt.Errorf("preparing image: %w", err)
 	}
 
+	os.Remove(dlFile)
+
 	return nil
 }
 
-func loadManifests() ([]*Image, error) {
+// lockImage takes the file lock guarding writes of an image to the image store.
+func (r *ImageRepository) lockImage(ctx context.Context, checksum string) (func() error, error) {
+	lockPath := path.Join(r.dataDir, "locks", checksum+".lock")
+
+	unlock, err := lockFile(ctx, lockPath)
+
+	if err != nil {
+		return nil, fmt.Errorf("locking image: %w", err)
+	}
+
+	return unlock, nil
+}
+
+// loadManifests loads all YAML image manifests in a filesystem.
+func loadManifests(fsys fs.FS) ([]*Image, error) {
 	var imgs []*Image
 
-	err := fs.WalkDir(manifests, ".", func(filepath string, d fs.DirEntry, err error) error {
+	err := fs.WalkDir(fsys, ".", func(filepath string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -160,7 +475,7 @@ func loadManifests() ([]*Image, error) {
 			return nil
 		}
 
-		buf, err := manifests.ReadFile(filepath)
+		buf, err := fs.ReadFile(fsys, filepath)
 
 		if err != nil {
 			return fmt.Errorf("reading file %s: %w", filepath, err)
@@ -171,7 +486,7 @@ func loadManifests() ([]*Image, error) {
 		err = yaml.Unmarshal(buf, &img)
 
 		if err != nil {
-			return fmt.Errorf("parsing YAML: %w", err)
+			return fmt.Errorf("parsing YAML in %s: %w", filepath, err)
 		}
 
 		imgs = append(imgs, &img)
@@ -195,88 +510,3 @@ func ParseImageName(name string) (string, string, error) {
 
 	return parts[0], parts[1], nil
 }
-
-func DownloadFile(filepath string, url string, checksum string) error {
-	// TODO: use ctx here
-
-	tmpFile, err := os.Create(filepath + ".tmp")
-
-	if err != nil {
-		return err
-	}
-
-	resp, err := http.Get(url)
-
-	if err != nil {
-		tmpFile.Close()
-		return err
-	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("downloading image %s: HTTP error %s", url, resp.Status)
-	}
-
-	byteSize := resp.ContentLength
-
-	prefix := "Downloading image"
-
-	onComplete := prefix + ": done"
-
-	// TODO: accept io writer for mpb output
-
-	p := mpb.New(
-		mpb.WithWidth(80),
-		mpb.WithRefreshRate(180*time.Millisecond),
-	)
-
-	bar := p.AddBar(byteSize,
-		mpb.BarFillerClearOnComplete(),
-		mpb.PrependDecorators(
-			decor.OnComplete(decor.Name(prefix), onComplete),
-		),
-		mpb.AppendDecorators(
-			decor.OnComplete(decor.CountersKibiByte("%.1f / %.1f"), ""),
-		),
-	)
-
-	proxyReader := bar.ProxyReader(resp.Body)
-
-	if _, err := io.Copy(tmpFile, proxyReader); err != nil {
-		_ = proxyReader.Close()
-		return err
-	}
-
-	p.Wait()
-
-	if err := proxyReader.Close(); err != nil {
-		return fmt.Errorf("closing image download reader: %w", err)
-	}
-
-	if _, err = tmpFile.Seek(0, 0); err != nil {
-		return fmt.Errorf("seeking image file: %w", err)
-	}
-
-	h := sha256.New()
-
-	if _, err := io.Copy(h, tmpFile); err != nil {
-		return fmt.Errorf("verify checksum: %w", err)
-	}
-
-	sum := hex.EncodeToString(h.Sum(nil))
-
-	if sum != checksum {
-		return fmt.Errorf("checksum %s does not match expected sum %s", sum, checksum)
-	}
-
-	tmpFile.Close()
-
-	// TODO: if compression is specified, decompress
-
-	if err = os.Rename(filepath+".tmp", filepath); err != nil {
-		return err
-	}
-
-	return nil
-}
@@ -0,0 +1,131 @@
+package fog
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pullConcurrently runs concurrent pulls of an image once the first has reached
+// the server, and returns their errors with the first pull's error first.
+func pullConcurrently(t *testing.T, r *ImageRepository, img *Image, requested <-chan struct{}, n int, first context.Context) []error {
+	t.Helper()
+
+	errs := make([]error, n)
+
+	var wg sync.WaitGroup
+
+	pull := func(i int, ctx context.Context) {
+		defer wg.Done()
+
+		errs[i] = r.Pull(ctx, img, ImagePullOptions{Download: DownloadOptions{Retries: -1}})
+	}
+
+	wg.Add(n)
+
+	go pull(0, first)
+
+	<-requested
+
+	for i := 1; i < n; i++ {
+		go pull(i, context.Background())
+	}
+
+	wg.Wait()
+
+	return errs
+}
+
+func TestPullCoalesces(t *testing.T) {
+	var requests atomic.Int32
+
+	requested := make(chan struct{}, 1)
+
+	// The download fails, which later callers would retry if their pulls weren't coalesced
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+
+		// Give the other callers time to join the pull
+		time.Sleep(100 * time.Millisecond)
+
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+
+	defer srv.Close()
+
+	r := newTestRepository(t, RepositoryOptions{})
+
+	img := &Image{Name: "test", Url: srv.URL + "/disk.qcow2", Checksum: sha256Hex("disk")}
+
+	for i, err := range pullConcurrently(t, r, img, requested, 4, context.Background()) {
+		if err == nil {
+			t.Fatalf("pull %d succeeded, want the failure of the first pull", i)
+		}
+	}
+
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("image was downloaded %d times, want 1", n)
+	}
+}
+
+func TestPullRetriesAfterCancelledCaller(t *testing.T) {
+	var requests atomic.Int32
+
+	requested := make(chan struct{}, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first download hangs until its caller gives up
+		if requests.Add(1) == 1 {
+			requested <- struct{}{}
+			<-r.Context().Done()
+
+			return
+		}
+
+		w.Write([]byte("disk"))
+	}))
+
+	defer srv.Close()
+
+	r := newTestRepository(t, RepositoryOptions{})
+
+	img := &Image{Name: "test", Url: srv.URL + "/disk.qcow2", Checksum: sha256Hex("disk")}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		// Give the other callers time to join the pull
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	errs := pullConcurrently(t, r, img, requested, 3, ctx)
+
+	if errs[0] == nil {
+		t.Fatal("expected the cancelled pull to fail")
+	}
+
+	for i, err := range errs[1:] {
+		if err != nil {
+			t.Fatalf("pull %d inherited the cancellation: %v", i+1, err)
+		}
+	}
+
+	if n := requests.Load(); n != 2 {
+		t.Fatalf("image was downloaded %d times, want 2", n)
+	}
+
+	if _, err := os.Stat(r.ImagePath(img)); err != nil {
+		t.Fatal(err)
+	}
+}
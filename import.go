@@ -0,0 +1,276 @@
+package fog
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// qcow2Magic is the magic number at the start of qcow2 files.
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+// ImportOptions configures an image import.
+type ImportOptions struct {
+	// Name is the image name to register
+	Name string
+	// Tag is the image tag to register, "latest" by default
+	Tag string
+	// Arch is the architecture of the image
+	Arch string
+	// Username is the default user of the image
+	Username string
+	// Format is the disk format of the source file, detected by default
+	Format string
+}
+
+// Import copies a local disk image into the image store and registers a manifest for it.
+//
+// Images in formats other than qcow2, and qcow2 overlays with a backing file, are
+// converted with qemu-img. The manifest is written to the user's image manifest
+// directory so it is available to later runs.
+func (r *ImageRepository) Import(ctx context.Context, src string, opts ImportOptions) (*Image, error) {
+	if opts.Name == "" {
+		return nil, errors.New("image name is required")
+	}
+
+	if opts.Tag == "" {
+		opts.Tag = "latest"
+	}
+
+	format := opts.Format
+
+	if format == "" {
+		f, err := detectFormat(ctx, src)
+
+		if err != nil {
+			return nil, fmt.Errorf("detecting image format: %w", err)
+		}
+
+		format = f
+	}
+
+	tmpPath, err := r.tempImagePath()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.Remove(tmpPath)
+
+	backed := false
+
+	if format == "qcow2" {
+		backed, err = hasBackingFile(src)
+
+		if err != nil {
+			return nil, fmt.Errorf("reading image header: %w", err)
+		}
+	}
+
+	// Overlays are flattened, since their backing file isn't imported with them
+	if format == "qcow2" && !backed {
+		err = copyFile(src, tmpPath)
+	} else {
+		err = convertImage(ctx, src, format, tmpPath)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("importing image: %w", err)
+	}
+
+	sum, err := r.storeImage(ctx, tmpPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{
+		Name:     opts.Name,
+		Checksum: sum,
+		Arch:     opts.Arch,
+		Tags:     []string{opts.Tag},
+		Username: opts.Username,
+	}
+
+	if err := r.Register(img); err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
+
+// Register writes a manifest to the user's image manifest directory and adds it to the loaded manifests.
+// An existing manifest registered with the same name and first tag is replaced.
+func (r *ImageRepository) Register(img *Image) error {
+	dir := r.manifestDirs[0]
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("creating manifest directory: %w", err)
+	}
+
+	buf, err := yaml.Marshal(img)
+
+	if err != nil {
+		return fmt.Errorf("encoding manifest: %w", err)
+	}
+
+	name := img.Name
+
+	if len(img.Tags) > 0 {
+		name += "-" + img.Tags[0]
+	}
+
+	name = strings.NewReplacer("/", "_", ":", "_").Replace(name)
+
+	if err := os.WriteFile(path.Join(dir, name+".yaml"), buf, 0644); err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+
+	// Project manifests still take precedence, just like when loading them
+	i := len(r.projectImgs)
+
+	if i > len(r.imgs) {
+		i = len(r.imgs)
+	}
+
+	r.imgs = append(r.imgs[:i], append([]*Image{img}, r.imgs[i:]...)...)
+
+	return nil
+}
+
+// tempImagePath returns a unique path for a temporary file in the image store.
+func (r *ImageRepository) tempImagePath() (string, error) {
+	dir := path.Join(r.dataDir, "images")
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", fmt.Errorf("creating image directory: %w", err)
+	}
+
+	b := make([]byte, 8)
+
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+
+	return path.Join(dir, "import-"+hex.EncodeToString(b)+".tmp"), nil
+}
+
+// storeImage moves a qcow2 file into the image store under its checksum and returns the checksum.
+func (r *ImageRepository) storeImage(ctx context.Context, src string) (string, error) {
+	sum, err := fileChecksum(src)
+
+	if err != nil {
+		return "", fmt.Errorf("computing checksum: %w", err)
+	}
+
+	unlock, err := r.lockImage(ctx, sum)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer unlock()
+
+	if err := os.Rename(src, r.ImagePath(&Image{Checksum: sum})); err != nil {
+		return "", fmt.Errorf("storing image: %w", err)
+	}
+
+	return sum, nil
+}
+
+// detectFormat detects the disk format of an image file.
+func detectFormat(ctx context.Context, src string) (string, error) {
+	f, err := os.Open(src)
+
+	if err != nil {
+		return "", err
+	}
+
+	magic := make([]byte, len(qcow2Magic))
+
+	_, err = io.ReadFull(f, magic)
+
+	f.Close()
+
+	if err == nil && bytes.Equal(magic, qcow2Magic) {
+		return "qcow2", nil
+	}
+
+	bin, err := exec.LookPath("qemu-img")
+
+	if err != nil {
+		return "", fmt.Errorf("finding qemu-img binary: %w", err)
+	}
+
+	out, err := exec.CommandContext(ctx, bin, "info", "--output=json", src).Output()
+
+	if err != nil {
+		return "", fmt.Errorf("reading image info: %w", err)
+	}
+
+	info := struct {
+		Format string `json:"format"`
+	}{}
+
+	if err := json.Unmarshal(out, &info); err != nil {
+		return "", fmt.Errorf("parsing image info: %w", err)
+	}
+
+	return info.Format, nil
+}
+
+// hasBackingFile reports whether a qcow2 file is an overlay with a backing file.
+func hasBackingFile(src string) (bool, error) {
+	f, err := os.Open(src)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer f.Close()
+
+	// The header starts with the magic, the version and the offset of the backing file name
+	header := make([]byte, 16)
+
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false, err
+	}
+
+	return binary.BigEndian.Uint64(header[8:16]) != 0, nil
+}
+
+// copyFile copies the contents of a file.
+func copyFile(src string, dest string) error {
+	in, err := os.Open(src)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.Create(dest)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,85 @@
+package fog
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// writeQcow2Header writes a qcow2 header, with a backing file if backing is not empty.
+func writeQcow2Header(t *testing.T, p string, backing string) {
+	t.Helper()
+
+	header := make([]byte, 72)
+	copy(header, qcow2Magic)
+	binary.BigEndian.PutUint32(header[4:8], 3)
+
+	if backing != "" {
+		binary.BigEndian.PutUint64(header[8:16], uint64(len(header)))
+		binary.BigEndian.PutUint32(header[16:20], uint32(len(backing)))
+		header = append(header, backing...)
+	}
+
+	if err := os.WriteFile(p, header, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportFlattensOverlays(t *testing.T) {
+	// A fake qemu-img records its arguments and writes the converted image
+	bin := t.TempDir()
+	args := path.Join(bin, "args")
+
+	script := "#!/bin/sh\necho \"$@\" > " + args + "\necho converted > \"$7\"\n"
+
+	if err := os.WriteFile(path.Join(bin, "qemu-img"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	src := t.TempDir()
+
+	tests := []struct {
+		name    string
+		backing string
+		convert bool
+	}{
+		{"standalone", "", false},
+		{"overlay", "base.qcow2", true},
+	}
+
+	for _, tt := range tests {
+		os.Remove(args)
+
+		r := newTestRepository(t, RepositoryOptions{})
+		r.manifestDirs = []string{t.TempDir()}
+
+		p := path.Join(src, tt.name+".qcow2")
+		writeQcow2Header(t, p, tt.backing)
+
+		img, err := r.Import(context.Background(), p, ImportOptions{Name: tt.name})
+
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		buf, err := os.ReadFile(args)
+		converted := err == nil
+
+		if converted != tt.convert {
+			t.Fatalf("%s: converted = %v, want %v", tt.name, converted, tt.convert)
+		}
+
+		if converted && !strings.HasPrefix(string(buf), "convert -f qcow2 -O qcow2 "+p) {
+			t.Fatalf("%s: unexpected qemu-img arguments %q", tt.name, buf)
+		}
+
+		if _, err := os.Stat(r.ImagePath(img)); err != nil {
+			t.Fatalf("%s: image not stored: %v", tt.name, err)
+		}
+	}
+}
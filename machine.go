@@ -8,9 +8,12 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"os/exec"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/adrg/xdg"
@@ -28,7 +31,29 @@ type Machine struct {
 	qmpAddr string
 	connMu  sync.Mutex
 	conn    net.Conn
-	cmd     *exec.Cmd
+	// runMu guards last, which is replaced whenever the machine is started again
+	runMu sync.Mutex
+	// last is the machine's last run, or nil if it hasn't been started
+	last *machineRun
+	// stopping is set once the machine is being stopped
+	stopping atomic.Bool
+	// recorded is closed once the exit of the machine's last run has been recorded in the store
+	recorded chan struct{}
+	// prepareMu guards preparing the machine's disks, which sets ImgPath, disks and prepared
+	prepareMu sync.Mutex
+	// disks are the data disks attached in addition to the boot disk
+	disks []*machineDisk
+	// prepared is set once the machine's disks have been prepared
+	prepared bool
+}
+
+// machineRun is a run of a machine's QEMU process.
+type machineRun struct {
+	cmd *exec.Cmd
+	// exited is closed when the QEMU process has exited
+	exited chan struct{}
+	// err is the error the QEMU process exited with
+	err error
 }
 
 func NewMachine(name string, conf *MachineConfig, img *Image, imgPath string) *Machine {
@@ -46,31 +71,47 @@ func NewMachine(name string, conf *MachineConfig, img *Image, imgPath string) *M
 type StartOptions struct {
 	imdsPort int
 	output   io.Writer
+	// persistent writes changes to the disk image instead of discarding them
+	persistent bool
 }
 
 // Start boots the virtual machine
 func (m *Machine) Start(ctx context.Context, opts *StartOptions) error {
-	bin, err := exec.LookPath("qemu-system-x86_64")
+	arch := m.Conf.MachineArch()
+
+	prof, err := profileForArch(arch)
 
 	if err != nil {
-		return fmt.Errorf("finding qemu binary: %w", err)
+		return err
 	}
 
-	addr, err := xdg.RuntimeFile("fog/" + m.ID + ".sock")
+	bin, err := exec.LookPath(prof.binary)
 
 	if err != nil {
-		return fmt.Errorf("generating socket file path: %w", err)
+		return fmt.Errorf("finding qemu binary: %w", err)
 	}
 
-	m.addr = addr
+	// The socket paths only depend on the ID, so they are only set on the first
+	// start and can be read by other goroutines while the machine runs
+	if m.addr == "" {
+		addr, err := xdg.RuntimeFile("fog/" + m.ID + ".sock")
+
+		if err != nil {
+			return fmt.Errorf("generating socket file path: %w", err)
+		}
 
-	qmpAddr, err := xdg.RuntimeFile("fog/" + m.ID + "_qmp.sock")
+		qmpAddr, err := xdg.RuntimeFile("fog/" + m.ID + "_qmp.sock")
 
-	if err != nil {
-		return fmt.Errorf("generating monitor socket file path: %w", err)
+		if err != nil {
+			return fmt.Errorf("generating monitor socket file path: %w", err)
+		}
+
+		m.addr = addr
+		m.qmpAddr = qmpAddr
 	}
 
-	m.qmpAddr = qmpAddr
+	addr := m.addr
+	qmpAddr := m.qmpAddr
 
 	dsUrl := fmt.Sprintf("http://10.0.2.2:%d/%s/", opts.imdsPort, m.ID)
 
@@ -80,61 +121,266 @@ func (m *Machine) Start(ctx context.Context, opts *StartOptions) error {
 		fwds = fmt.Sprintf(",hostfwd=%s", strings.Join(m.Conf.Ports, ","))
 	}
 
+	accel, cpu, err := machineCpu(m.Name, m.Conf, prof)
+
+	if err != nil {
+		return err
+	}
+
+	machine := "accel=" + accel
+
+	if prof.machine != "" {
+		machine = prof.machine + "," + machine
+	}
+
+	nic := "nic"
+
+	if prof.virtio {
+		nic = "nic,model=virtio"
+	}
+
+	// Changes to the boot disk are discarded unless it is persistent
+	disks := append([]*machineDisk{{
+		id:       "root",
+		path:     m.ImgPath,
+		format:   "qcow2",
+		iface:    diskVirtioBlk,
+		snapshot: !opts.persistent && !m.Conf.Persistent,
+	}}, m.disks...)
+
 	args := []string{
 		// Machine settings
 		"-machine",
-		// TODO: only enable KVM when supported
-		"accel=kvm:tcg",
+		machine,
 		// System resources
 		"-cpu",
-		"host",
+		cpu,
+		"-smp",
+		smpArg(m.Conf),
 		"-m",
 		m.Conf.Memory,
 		// Graphics
 		"-nographic",
 		"-vga",
 		"none",
-		// Boot image
-		"-hda",
-		m.ImgPath,
-		"-snapshot",
+	}
+
+	if len(prof.firmware) > 0 {
+		fw, err := findFile(prof.firmware)
+
+		if err != nil {
+			return fmt.Errorf("finding %s firmware: %w", arch, err)
+		}
+
+		args = append(args, "-bios", fw)
+	}
+
+	if len(prof.kernel) > 0 {
+		kernel, err := findFile(prof.kernel)
+
+		if err != nil {
+			return fmt.Errorf("finding %s bootloader: %w", arch, err)
+		}
+
+		args = append(args, "-kernel", kernel)
+	}
+
+	// Disks
+	args = append(args, driveArgs(disks)...)
+
+	args = append(args,
 		// Networking
 		"-net",
-		"nic",
+		nic,
 		"-net",
-		"user" + fwds,
+		"user"+fwds,
 		// Stdio
 		"-chardev",
-		"socket,id=serdev,path=" + addr + ",server=on,wait=off",
+		"socket,id=serdev,path="+addr+",server=on,wait=off",
 		"-serial",
 		"chardev:serdev",
 		// QMP
 		"-chardev",
-		"socket,id=qmpdev,path=" + qmpAddr + ",server=on,wait=off",
+		"socket,id=qmpdev,path="+qmpAddr+",server=on,wait=off",
 		"-mon",
-		"qmpdev",
+		"chardev=qmpdev,mode=control",
 		// Cloud init
 		"-smbios",
-		"type=1,serial=ds=nocloud-net;s=" + dsUrl,
-	}
+		"type=1,serial=ds=nocloud-net;s="+dsUrl,
+	)
 
-	log.Debug("Starting machine", "name", m.Name, "sock", addr, "mon", qmpAddr)
+	log.Debug("Starting machine", "name", m.Name, "arch", arch, "accel", accel, "cpu", cpu, "sock", addr, "mon", qmpAddr)
 
 	cmd := exec.Command(bin, args...)
 
-	m.cmd = cmd
+	// A process group of its own keeps Ctrl+C in the terminal from killing QEMU
+	// before the machine can be shut down gracefully
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	m.stopping.Store(false)
+
+	// A previous run's console connection is closed
+	m.connMu.Lock()
+	m.conn = nil
+	m.connMu.Unlock()
 
 	if out := opts.output; out != nil {
 		cmd.Stdout = out
 		cmd.Stderr = out
 	}
 
-	err = cmd.Start()
+	return m.run(cmd)
+}
 
-	if err != nil {
+// run starts the machine's QEMU process and waits for it to exit in the background.
+func (m *Machine) run(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("executing QEMU command: %w", err)
 	}
 
+	r := &machineRun{
+		cmd:    cmd,
+		exited: make(chan struct{}),
+	}
+
+	go func() {
+		r.err = cmd.Wait()
+		close(r.exited)
+	}()
+
+	m.runMu.Lock()
+	m.last = r
+	m.runMu.Unlock()
+
+	return nil
+}
+
+// lastRun returns the machine's last run, or nil if it hasn't been started.
+func (m *Machine) lastRun() *machineRun {
+	m.runMu.Lock()
+
+	defer m.runMu.Unlock()
+
+	return m.last
+}
+
+// running reports whether the machine's QEMU process is running.
+func (m *Machine) running() bool {
+	r := m.lastRun()
+
+	if r == nil {
+		return false
+	}
+
+	select {
+	case <-r.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// Wait waits for the QEMU process of the machine's last run to exit.
+func (m *Machine) Wait() error {
+	r := m.lastRun()
+
+	if r == nil {
+		return nil
+	}
+
+	<-r.exited
+
+	return r.err
+}
+
+// Stop shuts the machine down gracefully, and kills it if it doesn't power off within the timeout.
+// The machine is killed immediately when the context is done.
+func (m *Machine) Stop(ctx context.Context, timeout time.Duration) error {
+	m.stopping.Store(true)
+
+	r := m.lastRun()
+
+	if r == nil {
+		return nil
+	}
+
+	select {
+	case <-r.exited:
+		return nil
+	default:
+	}
+
+	pctx, cancel := context.WithTimeout(ctx, qmpTimeout)
+	err := m.Powerdown(pctx)
+	cancel()
+
+	if err != nil {
+		log.Warn("Powering off machine failed, killing it", "machine", m.Name, "error", err)
+
+		return m.kill(r)
+	}
+
+	select {
+	case <-r.exited:
+		log.Debug("Machine powered off", "machine", m.Name)
+
+		return nil
+	case <-time.After(timeout):
+		log.Warn("Machine did not power off in time, killing it", "machine", m.Name, "timeout", timeout)
+	case <-ctx.Done():
+		log.Warn("Killing machine", "machine", m.Name)
+	}
+
+	return m.kill(r)
+}
+
+// recordStart records a started machine in its state.
+func (m *Machine) recordStart(st *MachineState) error {
+	st.ID = m.ID
+	st.Pid = m.lastRun().cmd.Process.Pid
+	// Without a start time other fog processes refuse to kill the machine
+	st.PidStart, _ = processStartTime(st.Pid)
+	st.Socket = m.addr
+	st.QmpSocket = m.qmpAddr
+	st.Ports = m.Conf.Ports
+	st.StopTimeout = m.Conf.stopTimeout()
+	st.Disks = []string{m.ImgPath}
+	st.Status = MachineRunning
+	st.CloudInit = CloudInitRunning
+	st.Started = time.Now()
+
+	for _, d := range m.disks {
+		st.Disks = append(st.Disks, d.path)
+	}
+
+	return nil
+}
+
+// recordExit records an exited machine in its state.
+func (m *Machine) recordExit(st *MachineState) error {
+	// The machine may have been stopped by another fog process
+	stopped := m.stopping.Load() || st.Status == MachineStopping || st.Status == MachineStopped
+
+	st.Pid = 0
+	st.PidStart = 0
+	st.CloudInit = ""
+	st.Status = MachineExited
+
+	if stopped {
+		st.Status = MachineStopped
+	}
+
+	return nil
+}
+
+// kill kills the QEMU process of a run of the machine and waits for it to exit.
+func (m *Machine) kill(r *machineRun) error {
+	if err := r.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("killing machine %s: %w", m.Name, err)
+	}
+
+	<-r.exited
+
 	return nil
 }
 
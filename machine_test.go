@@ -0,0 +1,94 @@
+package fog
+
+import (
+	"context"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+)
+
+// runTestMachine runs a sleeping process in place of QEMU for a machine with a QMP socket.
+func runTestMachine(t *testing.T, qmpAddr string) *Machine {
+	t.Helper()
+
+	m := &Machine{Name: "test", qmpAddr: qmpAddr}
+
+	if err := m.run(exec.Command("sleep", "60")); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { m.kill(m.lastRun()) })
+
+	return m
+}
+
+func TestMachineStopKillsAfterTimeout(t *testing.T) {
+	powerdown := make(chan struct{}, 1)
+
+	// The guest ignores the power off request
+	addr := serveFakeQmp(t, func(c *fakeQmpConn) {
+		req, ok := c.next()
+
+		if ok && req.Execute == "system_powerdown" {
+			powerdown <- struct{}{}
+		}
+
+		c.reply(req, nil)
+	})
+
+	m := runTestMachine(t, addr)
+
+	start := time.Now()
+
+	if err := m.Stop(context.Background(), 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.running() {
+		t.Fatal("machine is still running")
+	}
+
+	select {
+	case <-powerdown:
+	default:
+		t.Fatal("machine was not asked to power off")
+	}
+
+	if d := time.Since(start); d < 200*time.Millisecond || d > 5*time.Second {
+		t.Fatalf("machine was killed after %s, want the stop timeout", d)
+	}
+}
+
+func TestMachineStopKillsWithoutQmp(t *testing.T) {
+	m := runTestMachine(t, path.Join(t.TempDir(), "missing.sock"))
+
+	if err := m.Stop(context.Background(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.running() {
+		t.Fatal("machine is still running")
+	}
+}
+
+func TestMachineStopKillsWhenContextDone(t *testing.T) {
+	addr := serveFakeQmp(t, func(c *fakeQmpConn) {
+		req, _ := c.next()
+		c.reply(req, nil)
+	})
+
+	m := runTestMachine(t, addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+
+	defer cancel()
+
+	if err := m.Stop(ctx, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.running() {
+		t.Fatal("machine is still running")
+	}
+}
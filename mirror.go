@@ -0,0 +1,165 @@
+package fog
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Mirror rewrites URLs starting with a prefix to a mirror.
+type Mirror struct {
+	// From is the URL prefix to rewrite
+	From string
+	// To replaces the prefix
+	To string
+}
+
+// ProxyConfig configures the HTTP proxy used for downloads.
+// Without any settings the standard proxy environment variables are used.
+type ProxyConfig struct {
+	// Http is the proxy for HTTP requests
+	Http string
+	// Https is the proxy for HTTPS requests
+	Https string
+	// NoProxy is a comma separated list of hosts which are accessed directly
+	NoProxy string `yaml:"no_proxy" mapstructure:"no_proxy"`
+}
+
+// NewHTTPClient creates the HTTP client used for downloads from the proxy and CA settings of the global config.
+func NewHTTPClient(conf *GlobalConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	p := conf.Proxy
+
+	if p.Http != "" || p.Https != "" || p.NoProxy != "" {
+		proxyFunc := (&httpproxy.Config{
+			HTTPProxy:  p.Http,
+			HTTPSProxy: p.Https,
+			NoProxy:    p.NoProxy,
+		}).ProxyFunc()
+
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			return proxyFunc(req.URL)
+		}
+	}
+
+	if conf.CaBundle != "" {
+		pool, err := x509.SystemCertPool()
+
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := os.ReadFile(conf.CaBundle)
+
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", conf.CaBundle)
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// candidateUrls returns the URLs an image can be downloaded from in the order they should be tried.
+// Mirrors of a URL are tried before the URL itself, followed by the image's fallback URLs.
+func (r *ImageRepository) candidateUrls(img *Image) []string {
+	var urls []string
+
+	seen := make(map[string]bool)
+
+	for _, u := range append([]string{img.Url}, img.FallbackUrls...) {
+		for _, m := range r.mirrors {
+			if m.From != "" && strings.HasPrefix(u, m.From) {
+				mirrored := m.To + strings.TrimPrefix(u, m.From)
+
+				if !seen[mirrored] {
+					seen[mirrored] = true
+					urls = append(urls, mirrored)
+				}
+			}
+		}
+
+		if !seen[u] {
+			seen[u] = true
+			urls = append(urls, u)
+		}
+	}
+
+	return urls
+}
+
+// downloadFromMirrors downloads an image to a file from the first candidate URL that succeeds.
+// With LAN sharing enabled, peers having the image are tried first.
+//
+// A failing candidate is only retried if it is the last one, otherwise the
+// download fails over to the next candidate right away.
+func (r *ImageRepository) downloadFromMirrors(ctx context.Context, img *Image, filepath string, checksum string, opts DownloadOptions) error {
+	var errs []error
+
+	if r.lanSharing && peerEligible(img) {
+		for _, u := range findPeers(img.Checksum) {
+			peerOpts := opts
+			peerOpts.Retries = -1
+			peerOpts.client = peerClient
+
+			err := DownloadFile(ctx, filepath, u, checksum, peerOpts)
+
+			if err == nil {
+				log.Info("Downloaded image from peer", "url", u)
+
+				return nil
+			}
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			log.Warn("Download from peer failed", "url", u, "error", err)
+		}
+	}
+
+	urls := r.candidateUrls(img)
+
+	for i, u := range urls {
+		urlOpts := opts
+
+		if i < len(urls)-1 && opts.Retries == 0 {
+			urlOpts.Retries = -1
+		}
+
+		err := DownloadFile(ctx, filepath, u, checksum, urlOpts)
+
+		if err == nil {
+			log.Info("Downloaded image", "url", u)
+
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if i < len(urls)-1 {
+			log.Warn("Download failed, trying next mirror", "url", u, "error", err)
+		}
+
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
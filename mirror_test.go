@@ -0,0 +1,63 @@
+package fog
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDownloadFailsOverToNextMirror(t *testing.T) {
+	content := "fog image"
+
+	var mirrorRequests atomic.Int32
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorRequests.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+
+	defer mirror.Close()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(content))
+	}))
+
+	defer origin.Close()
+
+	r := newTestRepository(t, RepositoryOptions{
+		Mirrors: []Mirror{{From: origin.URL, To: mirror.URL}},
+	})
+
+	img := &Image{Name: "test", Url: origin.URL + "/image.qcow2", Checksum: sha256Hex(content)}
+
+	dest := path.Join(t.TempDir(), "image.qcow2")
+
+	start := time.Now()
+
+	if err := r.downloadFromMirrors(context.Background(), img, dest, img.Checksum, DownloadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := mirrorRequests.Load(); n != 1 {
+		t.Fatalf("mirror was requested %d times, want 1", n)
+	}
+
+	if d := time.Since(start); d >= retryBaseDelay {
+		t.Fatalf("failing over took %s, the mirror was retried", d)
+	}
+
+	buf, err := os.ReadFile(dest)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != content {
+		t.Fatal("downloaded file does not match")
+	}
+}
@@ -0,0 +1,864 @@
+package fog
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/adrg/xdg"
+)
+
+const (
+	// ociScheme prefixes image references pointing to an OCI registry
+	ociScheme = "oci://"
+	// ociDiskMediaType is the media type of layers holding a qcow2 disk
+	ociDiskMediaType = "application/vnd.fog.image.layer.v1.qcow2"
+	// ociConfigMediaType is the media type of the fog image config blob
+	ociConfigMediaType = "application/vnd.fog.image.config.v1+json"
+	// ociManifestMediaType is the media type of OCI image manifests
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	// ociIndexMediaType is the media type of OCI image indexes
+	ociIndexMediaType = "application/vnd.oci.image.index.v1+json"
+	// dockerManifestMediaType is the media type of Docker image manifests
+	dockerManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	// dockerListMediaType is the media type of Docker manifest lists
+	dockerListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// ociReference is a parsed reference to an image in an OCI registry.
+type ociReference struct {
+	host string
+	repo string
+	// ref is a tag or digest
+	ref string
+}
+
+// parseOciReference parses references like oci://registry.local/vm/ubuntu:22.04.
+func parseOciReference(raw string) (*ociReference, error) {
+	s := strings.TrimPrefix(raw, ociScheme)
+
+	host, rest, ok := strings.Cut(s, "/")
+
+	if !ok || host == "" || rest == "" {
+		return nil, fmt.Errorf("invalid OCI reference '%s'", raw)
+	}
+
+	ref := &ociReference{host: host, ref: "latest"}
+
+	if repo, digest, ok := strings.Cut(rest, "@"); ok {
+		ref.repo = repo
+		ref.ref = digest
+	} else if i := strings.LastIndex(rest, ":"); i >= 0 {
+		ref.repo = rest[:i]
+		ref.ref = rest[i+1:]
+	} else {
+		ref.repo = rest
+	}
+
+	if ref.repo == "" || ref.ref == "" {
+		return nil, fmt.Errorf("invalid OCI reference '%s'", raw)
+	}
+
+	return ref, nil
+}
+
+func (r *ociReference) String() string {
+	sep := ":"
+
+	if strings.HasPrefix(r.ref, "sha256:") {
+		sep = "@"
+	}
+
+	return ociScheme + r.host + "/" + r.repo + sep + r.ref
+}
+
+// ociDescriptor describes a blob or manifest in a registry.
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	Platform  *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+// ociManifest is an image manifest or index.
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        *ociDescriptor  `json:"config,omitempty"`
+	Layers        []ociDescriptor `json:"layers,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests,omitempty"`
+}
+
+// ociImageConfig is the config blob of images pushed by fog.
+type ociImageConfig struct {
+	Name     string `json:"name"`
+	Arch     string `json:"arch"`
+	Username string `json:"username,omitempty"`
+}
+
+// registryClient is a minimal client for the OCI distribution API.
+type registryClient struct {
+	scheme string
+	host   string
+	repo   string
+	// scope is the token scope requested when the registry requires authentication
+	scope  string
+	client *http.Client
+	mu     sync.Mutex
+	auth   string
+}
+
+// newRegistryClient creates a client for a repository.
+// Registries on the local host are accessed over plain HTTP.
+func newRegistryClient(client *http.Client, ref *ociReference, push bool) *registryClient {
+	scheme := "https"
+
+	hostname := ref.host
+
+	if h, _, ok := strings.Cut(hostname, ":"); ok {
+		hostname = h
+	}
+
+	if hostname == "localhost" || hostname == "127.0.0.1" {
+		scheme = "http"
+	}
+
+	scope := "repository:" + ref.repo + ":pull"
+
+	if push {
+		scope += ",push"
+	}
+
+	return &registryClient{
+		scheme: scheme,
+		host:   ref.host,
+		repo:   ref.repo,
+		scope:  scope,
+		client: client,
+	}
+}
+
+// url returns the URL of an API path within the repository.
+func (c *registryClient) url(p string) string {
+	return c.scheme + "://" + c.host + "/v2/" + c.repo + "/" + p
+}
+
+// do sends a request, authenticating and retrying once if the registry requires it.
+// The body must be nil or support GetBody so it can be resent.
+func (c *registryClient) do(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	auth := c.auth
+	c.mu.Unlock()
+
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := c.client.Do(req)
+
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || auth != "" {
+		return resp, err
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+
+	resp.Body.Close()
+
+	auth, err = c.authenticate(req.Context(), challenge)
+
+	if err != nil {
+		return nil, fmt.Errorf("authenticating to %s: %w", c.host, err)
+	}
+
+	c.mu.Lock()
+	c.auth = auth
+	c.mu.Unlock()
+
+	retry := req.Clone(req.Context())
+
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+
+		if err != nil {
+			return nil, err
+		}
+
+		retry.Body = body
+	}
+
+	retry.Header.Set("Authorization", auth)
+
+	return c.client.Do(retry)
+}
+
+// authenticate answers a WWW-Authenticate challenge and returns an Authorization header value.
+func (c *registryClient) authenticate(ctx context.Context, challenge string) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+
+	basic := dockerCredentials(c.host)
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if basic == "" {
+			return "", errors.New("registry requires credentials")
+		}
+
+		return "Basic " + basic, nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported authentication challenge '%s'", challenge)
+	}
+
+	attrs := parseChallenge(params)
+
+	realm, err := url.Parse(attrs["realm"])
+
+	if err != nil || attrs["realm"] == "" {
+		return "", fmt.Errorf("invalid token realm '%s'", attrs["realm"])
+	}
+
+	q := realm.Query()
+
+	if svc := attrs["service"]; svc != "" {
+		q.Set("service", svc)
+	}
+
+	q.Set("scope", c.scope)
+
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	if basic != "" {
+		req.Header.Set("Authorization", "Basic "+basic)
+	}
+
+	resp, err := c.client.Do(req)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("requesting token: HTTP error %s", resp.Status)
+	}
+
+	tok := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", fmt.Errorf("parsing token: %w", err)
+	}
+
+	if tok.Token == "" {
+		tok.Token = tok.AccessToken
+	}
+
+	return "Bearer " + tok.Token, nil
+}
+
+// parseChallenge parses the comma separated key="value" parameters of an authentication challenge.
+func parseChallenge(params string) map[string]string {
+	attrs := make(map[string]string)
+
+	for params != "" {
+		var kv string
+
+		key, rest, _ := strings.Cut(strings.TrimLeft(params, " ,"), "=")
+
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+
+			if end < 0 {
+				end = len(rest) - 1
+			}
+
+			kv = rest[1 : end+1]
+			params = rest[end+2:]
+		} else {
+			kv, params, _ = strings.Cut(rest, ",")
+		}
+
+		attrs[strings.ToLower(strings.TrimSpace(key))] = kv
+	}
+
+	return attrs
+}
+
+// dockerCredentials returns the base64 encoded basic credentials for a registry from the Docker config file.
+func dockerCredentials(host string) string {
+	buf, err := os.ReadFile(path.Join(xdg.Home, ".docker", "config.json"))
+
+	if err != nil {
+		return ""
+	}
+
+	conf := struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}{}
+
+	if err := json.Unmarshal(buf, &conf); err != nil {
+		return ""
+	}
+
+	for _, key := range []string{host, "https://" + host, "http://" + host} {
+		if a, ok := conf.Auths[key]; ok && a.Auth != "" {
+			return a.Auth
+		}
+	}
+
+	return ""
+}
+
+// getManifest fetches a manifest by tag or digest, verifying the digest of the response.
+func (c *registryClient) getManifest(ctx context.Context, ref string) (*ociManifest, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url("manifests/"+ref), nil)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	req.Header.Set("Accept", strings.Join([]string{ociManifestMediaType, ociIndexMediaType, dockerManifestMediaType, dockerListMediaType}, ", "))
+
+	resp, err := c.do(req)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", fmt.Errorf("fetching manifest %s: %w", ref, ErrImageNotFound)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("fetching manifest %s: HTTP error %s", ref, resp.Status)
+	}
+
+	buf, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	h := sha256.Sum256(buf)
+
+	digest := "sha256:" + hex.EncodeToString(h[:])
+
+	if strings.HasPrefix(ref, "sha256:") && ref != digest {
+		return nil, "", fmt.Errorf("manifest digest %s does not match expected digest %s", digest, ref)
+	}
+
+	m := &ociManifest{}
+
+	if err := json.Unmarshal(buf, m); err != nil {
+		return nil, "", fmt.Errorf("parsing manifest: %w", err)
+	}
+
+	if m.MediaType == "" {
+		m.MediaType = resp.Header.Get("Content-Type")
+	}
+
+	return m, digest, nil
+}
+
+// getBlob fetches a small blob and verifies its digest.
+func (c *registryClient) getBlob(ctx context.Context, digest string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url("blobs/"+digest), nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching blob %s: HTTP error %s", digest, resp.Status)
+	}
+
+	buf, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.Sum256(buf)
+
+	if sum := "sha256:" + hex.EncodeToString(h[:]); sum != digest {
+		return nil, fmt.Errorf("blob digest %s does not match expected digest %s", sum, digest)
+	}
+
+	return buf, nil
+}
+
+// hasBlob reports whether the repository already contains a blob.
+func (c *registryClient) hasBlob(ctx context.Context, digest string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.url("blobs/"+digest), nil)
+
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.do(req)
+
+	if err != nil {
+		return false, err
+	}
+
+	resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// putBlob uploads a blob in a single request, skipping blobs that already exist.
+func (c *registryClient) putBlob(ctx context.Context, digest string, size int64, open func() (io.ReadCloser, error)) error {
+	if ok, err := c.hasBlob(ctx, digest); err != nil || ok {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url("blobs/uploads/"), nil)
+
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("starting blob upload: HTTP error %s", resp.Status)
+	}
+
+	loc, err := resp.Location()
+
+	if err != nil {
+		return fmt.Errorf("reading upload location: %w", err)
+	}
+
+	q := loc.Query()
+	q.Set("digest", digest)
+	loc.RawQuery = q.Encode()
+
+	body, err := open()
+
+	if err != nil {
+		return err
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodPut, loc.String(), body)
+
+	if err != nil {
+		body.Close()
+		return err
+	}
+
+	req.GetBody = open
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err = c.do(req)
+
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("uploading blob %s: HTTP error %s", digest, resp.Status)
+	}
+
+	return nil
+}
+
+// putManifest uploads a manifest under a tag.
+func (c *registryClient) putManifest(ctx context.Context, tag string, m *ociManifest) error {
+	buf, err := json.Marshal(m)
+
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.url("manifests/"+tag), bytes.NewReader(buf))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", m.MediaType)
+
+	resp, err := c.do(req)
+
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("uploading manifest: HTTP error %s", resp.Status)
+	}
+
+	return nil
+}
+
+// resolveOci resolves an OCI reference to an image whose checksum is the digest of its disk layer.
+//
+// Layers with the fog disk media type are used as is. Otherwise the image is
+// assumed to be a KubeVirt style container disk, a single tar layer holding the
+// disk image.
+func resolveOci(ctx context.Context, client *http.Client, raw string, arch string) (*Image, error) {
+	ref, err := parseOciReference(raw)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := newRegistryClient(client, ref, false)
+
+	m, _, err := c.getManifest(ctx, ref.ref)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if m.MediaType == ociIndexMediaType || m.MediaType == dockerListMediaType {
+		desc, err := selectPlatform(m.Manifests, ociArch(arch))
+
+		if err != nil {
+			return nil, err
+		}
+
+		if m, _, err = c.getManifest(ctx, desc.Digest); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(m.Layers) == 0 {
+		return nil, errors.New("image manifest has no layers")
+	}
+
+	img := &Image{
+		Name: ref.host + "/" + ref.repo,
+		Tags: []string{ref.ref},
+		Arch: arch,
+	}
+
+	var layer *ociDescriptor
+
+	for i := range m.Layers {
+		if m.Layers[i].MediaType == ociDiskMediaType {
+			layer = &m.Layers[i]
+		}
+	}
+
+	if layer == nil {
+		layer = &m.Layers[len(m.Layers)-1]
+
+		img.Compression = "tar"
+
+		if strings.HasSuffix(layer.MediaType, "gzip") {
+			img.Compression = "tar.gz"
+		} else if strings.HasSuffix(layer.MediaType, "zstd") {
+			img.Compression = "tar.zst"
+		}
+	}
+
+	if m.Config != nil && m.Config.MediaType == ociConfigMediaType {
+		buf, err := c.getBlob(ctx, m.Config.Digest)
+
+		if err != nil {
+			return nil, err
+		}
+
+		conf := ociImageConfig{}
+
+		if err := json.Unmarshal(buf, &conf); err != nil {
+			return nil, fmt.Errorf("parsing image config: %w", err)
+		}
+
+		img.Username = conf.Username
+
+		if conf.Arch != "" {
+			img.Arch = normalizeArch(conf.Arch)
+		}
+
+		if img.Arch != arch {
+			return nil, fmt.Errorf("image architecture %s does not match %s", img.Arch, arch)
+		}
+	}
+
+	sum, ok := strings.CutPrefix(layer.Digest, "sha256:")
+
+	if !ok {
+		return nil, fmt.Errorf("unsupported layer digest '%s'", layer.Digest)
+	}
+
+	img.Checksum = sum
+	img.Url = ociScheme + ref.host + "/" + ref.repo + "@" + layer.Digest
+
+	return img, nil
+}
+
+// lockOci records the build of a registry image used by a machine in the lock
+// file. Registry images have no manifest, so this keeps them when pruning.
+func (r *ImageRepository) lockOci(ctx context.Context, img *Image) error {
+	r.lockMu.Lock()
+	defer r.lockMu.Unlock()
+
+	unlock, err := r.lockUpdates(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	lock, err := r.readLock()
+
+	if err != nil {
+		return err
+	}
+
+	key := lockKey(img.Name, img.Tags[0], img.Arch)
+
+	if locked, ok := lock.Images[key]; ok && locked.Checksum == img.Checksum {
+		return nil
+	}
+
+	lock.Images[key] = &LockedImage{Url: img.Url, Checksum: img.Checksum}
+
+	return r.writeLock(lock)
+}
+
+// selectPlatform selects the manifest for an architecture from an index.
+func selectPlatform(manifests []ociDescriptor, arch string) (*ociDescriptor, error) {
+	for i, d := range manifests {
+		if d.Platform == nil || d.Platform.Architecture == arch {
+			return &manifests[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no manifest for architecture %s", arch)
+}
+
+// ociBlobRequest returns the blob URL and authorization header for a layer reference
+// of the form oci://host/repo@sha256:digest.
+func ociBlobRequest(ctx context.Context, client *http.Client, raw string) (string, http.Header, error) {
+	ref, err := parseOciReference(raw)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	c := newRegistryClient(client, ref, false)
+
+	// Probe the blob to obtain a token if the registry requires one
+	if _, err := c.hasBlob(ctx, ref.ref); err != nil {
+		return "", nil, err
+	}
+
+	header := make(http.Header)
+
+	if c.auth != "" {
+		header.Set("Authorization", c.auth)
+	}
+
+	return c.url("blobs/" + ref.ref), header, nil
+}
+
+// ociProvider provides images from repositories below a prefix in an OCI registry.
+// Images are resolved on demand, as registries can't be listed portably.
+type ociProvider struct {
+	client *http.Client
+	// prefix is the registry and repository prefix, such as oci://registry.local/vm
+	prefix string
+}
+
+func newOciProvider(conf ProviderConfig, client *http.Client) (ImageProvider, error) {
+	if !strings.HasPrefix(conf.Url, ociScheme) {
+		return nil, fmt.Errorf("invalid OCI provider URL '%s'", conf.Url)
+	}
+
+	return &ociProvider{client: client, prefix: strings.TrimSuffix(conf.Url, "/")}, nil
+}
+
+func (p *ociProvider) List(ctx context.Context) ([]*Image, error) {
+	return nil, nil
+}
+
+func (p *ociProvider) Resolve(ctx context.Context, name string, tag string, arch string) (*Image, error) {
+	arch = normalizeArch(arch)
+
+	if arch == "" {
+		arch = HostArch()
+	}
+
+	img, err := resolveOci(ctx, p.client, p.prefix+"/"+name+":"+tag, arch)
+
+	if err != nil {
+		return nil, err
+	}
+
+	img.Name = name
+
+	return img, nil
+}
+
+func (p *ociProvider) Fetch(ctx context.Context, img *Image, w io.Writer) error {
+	url, header, err := ociBlobRequest(ctx, p.client, img.Url)
+
+	if err != nil {
+		return fmt.Errorf("resolving image blob: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header = header
+
+	resp, err := p.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &httpStatusError{url: url, status: resp.Status, code: resp.StatusCode}
+	}
+
+	_, err = io.Copy(w, resp.Body)
+
+	return err
+}
+
+func (p *ociProvider) fetchFile(ctx context.Context, img *Image, filepath string, checksum string, opts DownloadOptions) error {
+	url, header, err := ociBlobRequest(ctx, p.client, img.Url)
+
+	if err != nil {
+		return fmt.Errorf("resolving image blob: %w", err)
+	}
+
+	opts.header = header
+
+	return DownloadFile(ctx, filepath, url, checksum, opts)
+}
+
+// Push uploads a stored image to an OCI registry as an artifact with the fog disk media type.
+func (r *ImageRepository) Push(ctx context.Context, img *Image, raw string) error {
+	ref, err := parseOciReference(raw)
+
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(ref.ref, "sha256:") {
+		return errors.New("images must be pushed to a tag")
+	}
+
+	imgPath := r.ImagePath(img)
+
+	fi, err := os.Stat(imgPath)
+
+	if err != nil {
+		return fmt.Errorf("image %s is not stored locally: %w", img.Name, err)
+	}
+
+	// Imported and built images are stored under their checksum, but pulled
+	// images may be stored under the checksum of their download
+	sum, err := fileChecksum(imgPath)
+
+	if err != nil {
+		return fmt.Errorf("computing checksum: %w", err)
+	}
+
+	c := newRegistryClient(r.client, ref, true)
+
+	layer := ociDescriptor{
+		MediaType: ociDiskMediaType,
+		Digest:    "sha256:" + sum,
+		Size:      fi.Size(),
+	}
+
+	openLayer := func() (io.ReadCloser, error) {
+		return os.Open(imgPath)
+	}
+
+	if err := c.putBlob(ctx, layer.Digest, layer.Size, openLayer); err != nil {
+		return err
+	}
+
+	confBuf, err := json.Marshal(ociImageConfig{
+		Name:     img.Name,
+		Arch:     img.Arch,
+		Username: img.Username,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	confSum := sha256.Sum256(confBuf)
+
+	config := ociDescriptor{
+		MediaType: ociConfigMediaType,
+		Digest:    "sha256:" + hex.EncodeToString(confSum[:]),
+		Size:      int64(len(confBuf)),
+	}
+
+	openConfig := func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(confBuf)), nil
+	}
+
+	if err := c.putBlob(ctx, config.Digest, config.Size, openConfig); err != nil {
+		return err
+	}
+
+	return c.putManifest(ctx, ref.ref, &ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        &config,
+		Layers:        []ociDescriptor{layer},
+	})
+}
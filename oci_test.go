@@ -0,0 +1,214 @@
+package fog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testRegistry is an in-memory OCI registry which requires a bearer token.
+type testRegistry struct {
+	t     *testing.T
+	srv   *httptest.Server
+	mu    sync.Mutex
+	blobs map[string][]byte
+	// manifests are stored by tag and digest
+	manifests map[string][]byte
+	// scopes are the scopes of the issued tokens
+	scopes []string
+}
+
+const testRegistryToken = "test-token"
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	reg := &testRegistry{
+		t:         t,
+		blobs:     make(map[string][]byte),
+		manifests: make(map[string][]byte),
+	}
+
+	reg.srv = httptest.NewServer(reg)
+
+	t.Cleanup(reg.srv.Close)
+
+	return reg
+}
+
+// host returns the host of the registry, as used in OCI references.
+func (reg *testRegistry) host() string {
+	return strings.TrimPrefix(reg.srv.URL, "http://")
+}
+
+func (reg *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if r.URL.Path == "/token" {
+		if r.URL.Query().Get("service") != "test-registry" {
+			http.Error(w, "unknown service", http.StatusBadRequest)
+			return
+		}
+
+		reg.scopes = append(reg.scopes, r.URL.Query().Get("scope"))
+
+		json.NewEncoder(w).Encode(map[string]string{"token": testRegistryToken})
+
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer "+testRegistryToken {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test-registry"`, reg.srv.URL))
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+
+		return
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, "/v2/vm/test/")
+
+	switch {
+	case strings.HasPrefix(p, "manifests/") && r.Method == http.MethodGet:
+		buf, ok := reg.manifests[strings.TrimPrefix(p, "manifests/")]
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", ociManifestMediaType)
+		w.Write(buf)
+	case strings.HasPrefix(p, "manifests/") && r.Method == http.MethodPut:
+		buf, _ := io.ReadAll(r.Body)
+
+		h := sha256.Sum256(buf)
+
+		reg.manifests[strings.TrimPrefix(p, "manifests/")] = buf
+		reg.manifests["sha256:"+hex.EncodeToString(h[:])] = buf
+
+		w.WriteHeader(http.StatusCreated)
+	case p == "blobs/uploads/" && r.Method == http.MethodPost:
+		w.Header().Set("Location", "/v2/vm/test/blobs/uploads/1")
+		w.WriteHeader(http.StatusAccepted)
+	case strings.HasPrefix(p, "blobs/uploads/") && r.Method == http.MethodPut:
+		buf, _ := io.ReadAll(r.Body)
+
+		h := sha256.Sum256(buf)
+
+		digest := r.URL.Query().Get("digest")
+
+		if digest != "sha256:"+hex.EncodeToString(h[:]) {
+			http.Error(w, "digest mismatch", http.StatusBadRequest)
+			return
+		}
+
+		reg.blobs[digest] = buf
+
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(p, "blobs/"):
+		buf, ok := reg.blobs[strings.TrimPrefix(p, "blobs/")]
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write(buf)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestOciPushPull(t *testing.T) {
+	reg := newTestRegistry(t)
+
+	disk := strings.Repeat("qcow2 disk ", 1024)
+	sum := sha256Hex(disk)
+
+	r := newTestRepository(t, RepositoryOptions{})
+
+	img := &Image{Name: "test", Arch: "x86_64", Tags: []string{"1.0"}, Checksum: sum, Username: "fog"}
+
+	if err := os.MkdirAll(path.Dir(r.ImagePath(img)), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(r.ImagePath(img), []byte(disk), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ref := "oci://" + reg.host() + "/vm/test:1.0"
+
+	if err := r.Push(context.Background(), img, ref); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reg.scopes) != 1 || reg.scopes[0] != "repository:vm/test:pull,push" {
+		t.Fatalf("got token scopes %q, want a single push token", reg.scopes)
+	}
+
+	if _, ok := reg.manifests["1.0"]; !ok {
+		t.Fatal("manifest was not pushed to the tag")
+	}
+
+	pulled, err := resolveOci(context.Background(), http.DefaultClient, ref, "x86_64")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pulled.Checksum != sum || pulled.Username != "fog" || pulled.Compression != "" {
+		t.Fatalf("unexpected resolved image %+v", pulled)
+	}
+
+	if want := "oci://" + reg.host() + "/vm/test@sha256:" + sum; pulled.Url != want {
+		t.Fatalf("got layer reference %s, want %s", pulled.Url, want)
+	}
+
+	p := &ociProvider{client: http.DefaultClient}
+
+	dest := path.Join(t.TempDir(), "image.qcow2")
+
+	if err := p.fetchFile(context.Background(), pulled, dest, pulled.Checksum, DownloadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := os.ReadFile(dest)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != disk {
+		t.Fatal("pulled disk does not match")
+	}
+
+	if _, err := resolveOci(context.Background(), http.DefaultClient, "oci://"+reg.host()+"/vm/test:2.0", "x86_64"); !errors.Is(err, ErrImageNotFound) {
+		t.Fatalf("expected image not found for a tag which wasn't pushed, got %v", err)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	attrs := parseChallenge(`realm="https://auth.example.com/token",service="registry.example.com",scope="repository:vm/test:pull"`)
+
+	want := map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:vm/test:pull",
+	}
+
+	for k, v := range want {
+		if attrs[k] != v {
+			t.Errorf("%s = %q, want %q", k, attrs[k], v)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package fog
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/hashicorp/mdns"
+)
+
+const (
+	// peerService is the mDNS service advertising cached images
+	peerService = "_fog-images._tcp"
+	// peerQueryTimeout limits how long to wait for peers to respond
+	peerQueryTimeout = time.Second
+	// peerRefreshInterval is how often the advertised images are refreshed
+	peerRefreshInterval = time.Minute
+	// peerMaxImages caps the advertised images, so the mDNS response fits in a single packet
+	peerMaxImages = 16
+)
+
+// peerClient downloads from peers directly, bypassing any proxy.
+var peerClient = &http.Client{Transport: &http.Transport{}}
+
+// checksumPattern matches SHA256 checksums.
+var checksumPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ServePeers serves the stored images to other fog instances on the local network until the context is done.
+//
+// The checksums of the stored images are advertised over mDNS and the images
+// are served over HTTP. Only images downloaded from a public manifest URL are
+// shared, never imported or built images.
+func (r *ImageRepository) ServePeers(ctx context.Context) error {
+	l, err := net.Listen("tcp", ":0")
+
+	if err != nil {
+		return fmt.Errorf("opening peer server TCP connection: %w", err)
+	}
+
+	port := l.Addr().(*net.TCPAddr).Port
+
+	var mu sync.Mutex
+	var advertised []string
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/images/", func(w http.ResponseWriter, req *http.Request) {
+		sum := strings.TrimPrefix(req.URL.Path, "/images/")
+
+		mu.Lock()
+		shared := false
+
+		for _, txt := range advertised {
+			if txt == "sha256="+sum {
+				shared = true
+			}
+		}
+
+		mu.Unlock()
+
+		if !shared {
+			http.NotFound(w, req)
+			return
+		}
+
+		log.Debug("Serving image to peer", "checksum", sum, "peer", req.RemoteAddr)
+
+		http.ServeFile(w, req, r.ImagePath(&Image{Checksum: sum}))
+	})
+
+	srv := &http.Server{Handler: mux}
+
+	go srv.Serve(l)
+
+	defer srv.Close()
+
+	var mdnsSrv *mdns.Server
+
+	defer func() {
+		if mdnsSrv != nil {
+			mdnsSrv.Shutdown()
+		}
+	}()
+
+	t := time.NewTicker(peerRefreshInterval)
+
+	defer t.Stop()
+
+	for {
+		txt, err := r.peerTxt()
+
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		changed := strings.Join(txt, ",") != strings.Join(advertised, ",")
+		mu.Unlock()
+
+		if changed {
+			if mdnsSrv != nil {
+				mdnsSrv.Shutdown()
+			}
+
+			mdnsSrv, err = advertisePeer(port, txt)
+
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			advertised = txt
+			mu.Unlock()
+
+			log.Debug("Advertising images to peers", "port", port, "images", len(txt))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// peerTxt returns the mDNS TXT records advertising the stored images which can be shared with peers.
+// The most recently pulled images are advertised if there are more than peerMaxImages.
+func (r *ImageRepository) peerTxt() ([]string, error) {
+	imgs, err := r.Images()
+
+	if err != nil {
+		return nil, err
+	}
+
+	public := make(map[string]bool)
+
+	for _, img := range imgs {
+		if peerEligible(img) {
+			public[img.Checksum] = true
+		}
+	}
+
+	locals, err := r.LocalImages()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var txt []string
+
+	for _, l := range locals {
+		if len(txt) == peerMaxImages {
+			break
+		}
+
+		if public[l.Checksum] {
+			txt = append(txt, "sha256="+l.Checksum)
+		}
+	}
+
+	sort.Strings(txt)
+
+	return txt, nil
+}
+
+// advertisePeer starts an mDNS server advertising the peer service.
+func advertisePeer(port int, txt []string) (*mdns.Server, error) {
+	host, err := os.Hostname()
+
+	if err != nil {
+		return nil, fmt.Errorf("getting hostname: %w", err)
+	}
+
+	svc, err := mdns.NewMDNSService(host, peerService, "", "", port, nil, txt)
+
+	if err != nil {
+		return nil, fmt.Errorf("creating mdns service: %w", err)
+	}
+
+	server, err := mdns.NewServer(&mdns.Config{Zone: svc})
+
+	if err != nil {
+		return nil, fmt.Errorf("creating mdns server: %w", err)
+	}
+
+	return server, nil
+}
+
+// findPeers returns the URLs of an image on peers of the local network.
+func findPeers(checksum string) []string {
+	entriesCh := make(chan *mdns.ServiceEntry, 16)
+
+	done := make(chan []string)
+
+	go func() {
+		var urls []string
+
+		for entry := range entriesCh {
+			if entry.AddrV4 == nil {
+				continue
+			}
+
+			for _, f := range entry.InfoFields {
+				if f == "sha256="+checksum {
+					urls = append(urls, fmt.Sprintf("http://%s/images/%s", net.JoinHostPort(entry.AddrV4.String(), fmt.Sprint(entry.Port)), checksum))
+					break
+				}
+			}
+		}
+
+		done <- urls
+	}()
+
+	err := mdns.Query(&mdns.QueryParam{
+		Service:     peerService,
+		Timeout:     peerQueryTimeout,
+		Entries:     entriesCh,
+		DisableIPv6: true,
+	})
+
+	close(entriesCh)
+
+	urls := <-done
+
+	if err != nil {
+		log.Debug("Querying peers failed", "error", err)
+	}
+
+	return urls
+}
+
+// peerEligible reports whether an image can be shared with peers.
+// Peers serve the stored image, which only matches the checksum of images stored as downloaded.
+// Only images from a public http(s) URL are shared, as anyone on the network can fetch them.
+func peerEligible(img *Image) bool {
+	return img.Build == nil && !needsPreparing(img) && publicUrl(img.Url) && checksumPattern.MatchString(img.Checksum)
+}
+
+// publicUrl reports whether a URL is an http(s) URL without credentials.
+func publicUrl(raw string) bool {
+	u, err := url.Parse(raw)
+
+	if err != nil {
+		return false
+	}
+
+	return (u.Scheme == "http" || u.Scheme == "https") && u.User == nil
+}
@@ -0,0 +1,328 @@
+package fog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// fileScheme prefixes image URLs pointing to local files
+const fileScheme = "file://"
+
+// ErrImageNotFound is returned by providers which don't provide an image.
+var ErrImageNotFound = errors.New("image not found")
+
+// ImageProvider is a source of image manifests and image downloads.
+type ImageProvider interface {
+	// List returns the manifests of the images available from the provider.
+	List(ctx context.Context) ([]*Image, error)
+	// Resolve returns the image with a name and tag for an architecture, or ErrImageNotFound.
+	// An empty architecture matches images of any architecture.
+	Resolve(ctx context.Context, name string, tag string, arch string) (*Image, error)
+	// Fetch writes the download of an image to w.
+	Fetch(ctx context.Context, img *Image, w io.Writer) error
+}
+
+// fileFetcher is implemented by providers which download images to files
+// themselves, such as to resume interrupted downloads.
+type fileFetcher interface {
+	fetchFile(ctx context.Context, img *Image, filepath string, checksum string, opts DownloadOptions) error
+}
+
+// ProviderConfig configures an image provider in the global config.
+type ProviderConfig struct {
+	// Name identifies the provider in messages
+	Name string
+	// Type is the provider type: file, oci, s3 or a registered custom type
+	Type string
+	// Url is the location of the provider, such as file:///srv/images, oci://registry.local/vm or s3://bucket/images
+	Url string
+	// Endpoint is the URL of an S3 compatible service, AWS by default
+	Endpoint string
+	// Region is the S3 region, AWS_REGION or us-east-1 by default
+	Region string
+	// AccessKey is the S3 access key, AWS_ACCESS_KEY_ID by default
+	AccessKey string `yaml:"access_key" mapstructure:"access_key"`
+	// SecretKey is the S3 secret key, AWS_SECRET_ACCESS_KEY by default
+	SecretKey string `yaml:"secret_key" mapstructure:"secret_key"`
+	// Options are settings for custom provider types
+	Options map[string]string
+}
+
+// ProviderFactory creates an image provider from its config.
+// The client is the HTTP client configured for downloads.
+type ProviderFactory func(conf ProviderConfig, client *http.Client) (ImageProvider, error)
+
+var (
+	providerMu        sync.Mutex
+	providerFactories = map[string]ProviderFactory{
+		"file": newFileProvider,
+		"oci":  newOciProvider,
+		"s3":   newS3Provider,
+	}
+)
+
+// RegisterProvider registers a custom provider type which can be used in the global config.
+// Registering an existing type replaces it.
+func RegisterProvider(typ string, factory ProviderFactory) {
+	providerMu.Lock()
+	defer providerMu.Unlock()
+
+	providerFactories[typ] = factory
+}
+
+// NewProvider creates an image provider from its config.
+func NewProvider(conf ProviderConfig, client *http.Client) (ImageProvider, error) {
+	providerMu.Lock()
+	factory, ok := providerFactories[conf.Type]
+	providerMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("provider %s has unknown type '%s'", conf.Name, conf.Type)
+	}
+
+	p, err := factory(conf, client)
+
+	if err != nil {
+		return nil, fmt.Errorf("creating provider %s: %w", conf.Name, err)
+	}
+
+	return p, nil
+}
+
+// ProviderImages returns the image manifests of the configured providers.
+func (r *ImageRepository) ProviderImages(ctx context.Context) ([]*Image, error) {
+	var imgs []*Image
+
+	for _, p := range r.providers {
+		pimgs, err := p.List(ctx)
+
+		if err != nil {
+			return nil, fmt.Errorf("listing provider images: %w", err)
+		}
+
+		imgs = append(imgs, pimgs...)
+	}
+
+	return imgs, nil
+}
+
+// resolveProviders resolves an image from the configured providers, in order.
+func (r *ImageRepository) resolveProviders(ctx context.Context, name string, tag string, arch string) (*Image, error) {
+	for _, p := range r.providers {
+		img, err := p.Resolve(ctx, name, tag, arch)
+
+		if errors.Is(err, ErrImageNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		img.provider = p
+
+		return img, nil
+	}
+
+	return nil, ErrImageNotFound
+}
+
+// providerFor returns the provider to fetch an image from.
+// Images not resolved by a configured provider are fetched according to their URL scheme.
+func (r *ImageRepository) providerFor(img *Image) ImageProvider {
+	switch {
+	case img.provider != nil:
+		return img.provider
+	case strings.HasPrefix(img.Url, ociScheme):
+		return &ociProvider{client: r.client}
+	case strings.HasPrefix(img.Url, fileScheme):
+		return &fileProvider{}
+	case strings.HasPrefix(img.Url, s3Scheme):
+		return envS3Provider(r.client)
+	default:
+		return &manifestProvider{r: r}
+	}
+}
+
+// fetchImage downloads an image from a provider to a file and verifies its SHA256 checksum.
+// Verification is skipped if the checksum is empty.
+func (r *ImageRepository) fetchImage(ctx context.Context, p ImageProvider, img *Image, filepath string, checksum string, opts DownloadOptions) error {
+	if f, ok := p.(fileFetcher); ok {
+		return f.fetchFile(ctx, img, filepath, checksum, opts)
+	}
+
+	tmpPath := filepath + ".tmp"
+
+	f, err := os.Create(tmpPath)
+
+	if err != nil {
+		return err
+	}
+
+	err = p.Fetch(ctx, img, f)
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+
+		return err
+	}
+
+	if checksum != "" {
+		sum, err := fileChecksum(tmpPath)
+
+		if err != nil {
+			return fmt.Errorf("verify checksum: %w", err)
+		}
+
+		if sum != checksum {
+			os.Remove(tmpPath)
+
+			return fmt.Errorf("checksum %s does not match expected sum %s", sum, checksum)
+		}
+	}
+
+	if opts.verify != nil {
+		if err := opts.verify(tmpPath); err != nil {
+			os.Remove(tmpPath)
+
+			return err
+		}
+	}
+
+	return os.Rename(tmpPath, filepath)
+}
+
+// resolveFromList returns a copy of the first image matching a name, tag and architecture.
+func resolveFromList(imgs []*Image, name string, tag string, arch string) (*Image, error) {
+	arch = normalizeArch(arch)
+
+	for _, img := range imgs {
+		if img.Name != name {
+			continue
+		}
+
+		if arch != "" && img.Arch != "" && normalizeArch(img.Arch) != arch {
+			continue
+		}
+
+		for _, t := range img.Tags {
+			if t == tag {
+				res := *img
+
+				return &res, nil
+			}
+		}
+	}
+
+	return nil, ErrImageNotFound
+}
+
+// manifestProvider provides the images of the built-in, catalog, user and
+// project manifests, which are downloaded over HTTP.
+type manifestProvider struct {
+	r *ImageRepository
+}
+
+func (p *manifestProvider) List(ctx context.Context) ([]*Image, error) {
+	return p.r.Images()
+}
+
+func (p *manifestProvider) Resolve(ctx context.Context, name string, tag string, arch string) (*Image, error) {
+	return p.r.resolveManifest(ctx, name, tag, normalizeArch(arch), false)
+}
+
+func (p *manifestProvider) Fetch(ctx context.Context, img *Image, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, img.Url, nil)
+
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.r.client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &httpStatusError{url: img.Url, status: resp.Status, code: resp.StatusCode}
+	}
+
+	_, err = io.Copy(w, resp.Body)
+
+	return err
+}
+
+func (p *manifestProvider) fetchFile(ctx context.Context, img *Image, filepath string, checksum string, opts DownloadOptions) error {
+	return p.r.downloadFromMirrors(ctx, img, filepath, checksum, opts)
+}
+
+// fileProvider provides images from a local or network mounted directory.
+//
+// The directory contains YAML manifests, whose URLs may be relative to the directory.
+type fileProvider struct {
+	dir string
+}
+
+func newFileProvider(conf ProviderConfig, client *http.Client) (ImageProvider, error) {
+	dir, ok := strings.CutPrefix(conf.Url, fileScheme)
+
+	if !ok || dir == "" {
+		return nil, fmt.Errorf("invalid file provider URL '%s'", conf.Url)
+	}
+
+	return &fileProvider{dir: dir}, nil
+}
+
+func (p *fileProvider) List(ctx context.Context) ([]*Image, error) {
+	imgs, err := loadManifests(os.DirFS(p.dir))
+
+	if err != nil {
+		return nil, fmt.Errorf("loading image manifests from %s: %w", p.dir, err)
+	}
+
+	for _, img := range imgs {
+		if img.Url != "" && !strings.Contains(img.Url, "://") {
+			img.Url = fileScheme + path.Join(p.dir, img.Url)
+		}
+	}
+
+	return imgs, nil
+}
+
+func (p *fileProvider) Resolve(ctx context.Context, name string, tag string, arch string) (*Image, error) {
+	imgs, err := p.List(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resolveFromList(imgs, name, tag, arch)
+}
+
+func (p *fileProvider) Fetch(ctx context.Context, img *Image, w io.Writer) error {
+	f, err := os.Open(strings.TrimPrefix(img.Url, fileScheme))
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+
+	return err
+}
@@ -0,0 +1,408 @@
+package fog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const (
+	// qmpTimeout limits how long connecting to a QMP socket may take
+	qmpTimeout = 10 * time.Second
+	// qmpEventBuffer is the number of events buffered for each subscriber
+	qmpEventBuffer = 64
+)
+
+// ErrQmpClosed is returned by commands of a closed QMP connection.
+var ErrQmpClosed = errors.New("QMP connection closed")
+
+// QmpError is an error returned by a QMP command.
+type QmpError struct {
+	Command string
+	Class   string
+	Desc    string
+}
+
+func (e *QmpError) Error() string {
+	return fmt.Sprintf("QMP command %s failed: %s", e.Command, e.Desc)
+}
+
+// QmpEvent is an asynchronous event emitted by QEMU, such as SHUTDOWN or STOP.
+type QmpEvent struct {
+	Event     string
+	Data      json.RawMessage
+	Timestamp time.Time
+}
+
+// qmpMessage is any message received from a QMP server.
+type qmpMessage struct {
+	QMP    json.RawMessage
+	Id     string
+	Return json.RawMessage
+	Error  *struct {
+		Class string
+		Desc  string
+	}
+	Event     string
+	Data      json.RawMessage
+	Timestamp *struct {
+		Seconds      int64
+		Microseconds int64
+	}
+}
+
+// QmpClient is a connection to the QEMU Machine Protocol socket of a machine.
+//
+// Commands may be executed concurrently, and their responses are correlated
+// by ID. Asynchronous events are delivered to subscribers.
+type QmpClient struct {
+	conn  net.Conn
+	encMu sync.Mutex
+	enc   *json.Encoder
+	mu    sync.Mutex
+	// nextId is the ID of the next command
+	nextId uint64
+	// pending maps command IDs to the channels awaiting their responses
+	pending map[string]chan *qmpMessage
+	// subs are the channels of event subscribers
+	subs map[chan QmpEvent]bool
+	// done is closed when the connection is closed
+	done chan struct{}
+	err  error
+}
+
+// DialQmp connects to a QMP socket and negotiates capabilities.
+func DialQmp(ctx context.Context, addr string) (*QmpClient, error) {
+	d := net.Dialer{Timeout: qmpTimeout}
+
+	conn, err := d.DialContext(ctx, "unix", addr)
+
+	if err != nil {
+		return nil, fmt.Errorf("connecting to QMP socket: %w", err)
+	}
+
+	dec := json.NewDecoder(conn)
+
+	conn.SetReadDeadline(time.Now().Add(qmpTimeout))
+
+	greeting := qmpMessage{}
+
+	if err := dec.Decode(&greeting); err != nil {
+		conn.Close()
+
+		return nil, fmt.Errorf("reading QMP greeting: %w", err)
+	}
+
+	if greeting.QMP == nil {
+		conn.Close()
+
+		return nil, errors.New("invalid QMP greeting")
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	c := &QmpClient{
+		conn:    conn,
+		enc:     json.NewEncoder(conn),
+		pending: make(map[string]chan *qmpMessage),
+		subs:    make(map[chan QmpEvent]bool),
+		done:    make(chan struct{}),
+	}
+
+	go c.read(dec)
+
+	if err := c.Execute(ctx, "qmp_capabilities", nil, nil); err != nil {
+		c.Close()
+
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// read dispatches the messages received from the server until the connection fails.
+func (c *QmpClient) read(dec *json.Decoder) {
+	var err error
+
+	for {
+		msg := &qmpMessage{}
+
+		if err = dec.Decode(msg); err != nil {
+			break
+		}
+
+		if msg.Event != "" {
+			c.publish(msg)
+			continue
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[msg.Id]
+		delete(c.pending, msg.Id)
+		c.mu.Unlock()
+
+		if !ok {
+			log.Debug("Ignoring unexpected QMP response", "id", msg.Id)
+			continue
+		}
+
+		ch <- msg
+	}
+
+	c.mu.Lock()
+
+	if c.err == nil {
+		c.err = fmt.Errorf("reading QMP message: %w", err)
+	}
+
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+
+	for ch := range c.subs {
+		close(ch)
+		delete(c.subs, ch)
+	}
+
+	c.mu.Unlock()
+
+	close(c.done)
+}
+
+// publish delivers an event to all subscribers. Events are dropped for
+// subscribers whose buffer is full, so a slow subscriber can't block responses.
+func (c *QmpClient) publish(msg *qmpMessage) {
+	ev := QmpEvent{
+		Event: msg.Event,
+		Data:  msg.Data,
+	}
+
+	if ts := msg.Timestamp; ts != nil {
+		ev.Timestamp = time.Unix(ts.Seconds, ts.Microseconds*1000)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for ch := range c.subs {
+		select {
+		case ch <- ev:
+		default:
+			log.Debug("Dropping QMP event for slow subscriber", "event", ev.Event)
+		}
+	}
+}
+
+// Execute executes a QMP command with optional arguments and decodes its return value into result, if not nil.
+func (c *QmpClient) Execute(ctx context.Context, command string, args interface{}, result interface{}) error {
+	ch := make(chan *qmpMessage, 1)
+
+	c.mu.Lock()
+
+	if c.err != nil {
+		c.mu.Unlock()
+
+		return c.err
+	}
+
+	c.nextId++
+	id := "fog-" + strconv.FormatUint(c.nextId, 10)
+	c.pending[id] = ch
+
+	c.mu.Unlock()
+
+	req := struct {
+		Execute   string      `json:"execute"`
+		Arguments interface{} `json:"arguments,omitempty"`
+		Id        string      `json:"id"`
+	}{command, args, id}
+
+	c.encMu.Lock()
+	err := c.enc.Encode(req)
+	c.encMu.Unlock()
+
+	if err != nil {
+		c.forget(id)
+
+		return fmt.Errorf("sending QMP command %s: %w", command, err)
+	}
+
+	var msg *qmpMessage
+
+	select {
+	case msg = <-ch:
+	case <-ctx.Done():
+		c.forget(id)
+
+		return ctx.Err()
+	}
+
+	if msg == nil {
+		return fmt.Errorf("executing QMP command %s: %w", command, c.Err())
+	}
+
+	if msg.Error != nil {
+		return &QmpError{Command: command, Class: msg.Error.Class, Desc: msg.Error.Desc}
+	}
+
+	if result != nil {
+		if err := json.Unmarshal(msg.Return, result); err != nil {
+			return fmt.Errorf("parsing QMP response of %s: %w", command, err)
+		}
+	}
+
+	return nil
+}
+
+// forget stops waiting for the response of a command.
+func (c *QmpClient) forget(id string) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// Events returns a channel receiving the asynchronous events of the connection.
+// The channel is closed when the connection is closed.
+func (c *QmpClient) Events() <-chan QmpEvent {
+	ch := make(chan QmpEvent, qmpEventBuffer)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		close(ch)
+
+		return ch
+	}
+
+	c.subs[ch] = true
+
+	return ch
+}
+
+// Done returns a channel which is closed when the connection is closed.
+func (c *QmpClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error which closed the connection, if any.
+func (c *QmpClient) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// Close closes the connection.
+func (c *QmpClient) Close() error {
+	c.mu.Lock()
+
+	if c.err == nil {
+		c.err = ErrQmpClosed
+	}
+
+	c.mu.Unlock()
+
+	return c.conn.Close()
+}
+
+// MachineStatus is the run state of a machine reported by QEMU.
+type MachineStatus struct {
+	// Running is true if the guest's CPUs are running
+	Running bool `json:"running"`
+	// Status is the run state, such as running, paused or shutdown
+	Status string `json:"status"`
+}
+
+// qmpDo executes a QMP command on a new connection to a machine's QMP socket.
+//
+// QEMU only serves one client per QMP socket, so connections are not kept
+// open between commands to let other fog processes control the machine.
+func (m *Machine) qmpDo(ctx context.Context, command string, args interface{}, result interface{}) error {
+	c, err := DialQmp(ctx, m.qmpAddr)
+
+	if err != nil {
+		return err
+	}
+
+	defer c.Close()
+
+	return c.Execute(ctx, command, args, result)
+}
+
+// Status returns the run state of the machine.
+func (m *Machine) Status(ctx context.Context) (*MachineStatus, error) {
+	st := &MachineStatus{}
+
+	if err := m.qmpDo(ctx, "query-status", nil, st); err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// Pause pauses the machine's CPUs.
+func (m *Machine) Pause(ctx context.Context) error {
+	return m.qmpDo(ctx, "stop", nil, nil)
+}
+
+// Resume resumes a paused machine.
+func (m *Machine) Resume(ctx context.Context) error {
+	return m.qmpDo(ctx, "cont", nil, nil)
+}
+
+// Powerdown requests the guest to power off with an ACPI shutdown event.
+// The guest may take some time to shut down, or ignore the request.
+func (m *Machine) Powerdown(ctx context.Context) error {
+	return m.qmpDo(ctx, "system_powerdown", nil, nil)
+}
+
+// Reset resets the machine like a hardware reset.
+func (m *Machine) Reset(ctx context.Context) error {
+	return m.qmpDo(ctx, "system_reset", nil, nil)
+}
+
+// Quit exits QEMU immediately, without shutting down the guest.
+func (m *Machine) Quit(ctx context.Context) error {
+	err := m.qmpDo(ctx, "quit", nil, nil)
+
+	// QEMU may close the connection before responding
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	return err
+}
+
+// Events streams the machine's QMP events until the context is done or the machine exits.
+//
+// The events are received on a dedicated connection, which blocks other
+// clients of the QMP socket while open.
+func (m *Machine) Events(ctx context.Context) (<-chan QmpEvent, error) {
+	c, err := DialQmp(ctx, m.qmpAddr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	events := c.Events()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-c.Done():
+		}
+	}()
+
+	return events, nil
+}
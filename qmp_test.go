@@ -0,0 +1,305 @@
+package fog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeQmpConn is a connection to a fake QMP server, after capabilities were negotiated.
+type fakeQmpConn struct {
+	t    *testing.T
+	conn net.Conn
+	dec  *json.Decoder
+	enc  *json.Encoder
+}
+
+// fakeQmpRequest is a command received by a fake QMP server.
+type fakeQmpRequest struct {
+	Execute   string
+	Arguments json.RawMessage
+	Id        json.RawMessage
+}
+
+// next reads the next command, returning false if the client closed the connection.
+func (c *fakeQmpConn) next() (*fakeQmpRequest, bool) {
+	req := &fakeQmpRequest{}
+
+	if err := c.dec.Decode(req); err != nil {
+		return nil, false
+	}
+
+	return req, true
+}
+
+// reply sends the return value of a command.
+func (c *fakeQmpConn) reply(req *fakeQmpRequest, ret interface{}) {
+	if ret == nil {
+		ret = struct{}{}
+	}
+
+	c.enc.Encode(map[string]interface{}{"return": ret, "id": req.Id})
+}
+
+// event sends an asynchronous event.
+func (c *fakeQmpConn) event(name string) {
+	c.enc.Encode(map[string]interface{}{
+		"event":     name,
+		"data":      map[string]interface{}{},
+		"timestamp": map[string]int64{"seconds": 1700000000, "microseconds": 500},
+	})
+}
+
+// serveFakeQmp serves a fake QMP socket like QEMU's. Each connection is greeted
+// and must negotiate capabilities before serve is called with it.
+func serveFakeQmp(t *testing.T, serve func(c *fakeQmpConn)) string {
+	t.Helper()
+
+	addr := path.Join(t.TempDir(), "qmp.sock")
+
+	l, err := net.Listen("unix", addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			c := &fakeQmpConn{t: t, conn: conn, dec: json.NewDecoder(conn), enc: json.NewEncoder(conn)}
+
+			c.enc.Encode(map[string]interface{}{"QMP": map[string]interface{}{"version": map[string]interface{}{}, "capabilities": []string{}}})
+
+			req, ok := c.next()
+
+			if !ok {
+				conn.Close()
+				continue
+			}
+
+			// QEMU rejects all other commands until capabilities are negotiated
+			if req.Execute != "qmp_capabilities" {
+				t.Errorf("first command was %s, want qmp_capabilities", req.Execute)
+				c.enc.Encode(map[string]interface{}{"error": map[string]string{"class": "CommandNotFound", "desc": "Expecting capabilities negotiation"}, "id": req.Id})
+				conn.Close()
+
+				continue
+			}
+
+			c.reply(req, nil)
+
+			serve(c)
+
+			conn.Close()
+		}
+	}()
+
+	return addr
+}
+
+func TestQmpHandshake(t *testing.T) {
+	addr := serveFakeQmp(t, func(c *fakeQmpConn) {
+		for {
+			req, ok := c.next()
+
+			if !ok {
+				return
+			}
+
+			c.reply(req, MachineStatus{Running: true, Status: "running"})
+		}
+	})
+
+	m := &Machine{Name: "test", qmpAddr: addr}
+
+	st, err := m.Status(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !st.Running || st.Status != "running" {
+		t.Fatalf("got status %+v", st)
+	}
+}
+
+func TestQmpInvalidGreeting(t *testing.T) {
+	addr := path.Join(t.TempDir(), "hmp.sock")
+
+	l, err := net.Listen("unix", addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	// A monitor in the default readline mode speaks HMP instead of QMP
+	go func() {
+		conn, err := l.Accept()
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		conn.Write([]byte("QEMU 8.0.0 monitor - type 'help' for more information\r\n(qemu) "))
+
+		time.Sleep(time.Second)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	if _, err := DialQmp(ctx, addr); err == nil {
+		t.Fatal("connected to a human monitor")
+	}
+}
+
+func TestQmpCorrelatesResponses(t *testing.T) {
+	addr := serveFakeQmp(t, func(c *fakeQmpConn) {
+		var reqs []*fakeQmpRequest
+
+		for len(reqs) < 3 {
+			req, ok := c.next()
+
+			if !ok {
+				return
+			}
+
+			reqs = append(reqs, req)
+		}
+
+		// Respond in reverse order, each with the command it answers
+		for i := len(reqs) - 1; i >= 0; i-- {
+			c.reply(reqs[i], reqs[i].Arguments)
+		}
+
+		c.next()
+	})
+
+	c, err := DialQmp(context.Background(), addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	var wg sync.WaitGroup
+
+	for _, cmd := range []string{"first", "second", "third"} {
+		cmd := cmd
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			var res struct{ Command string }
+
+			if err := c.Execute(context.Background(), "echo", map[string]string{"command": cmd}, &res); err != nil {
+				t.Error(err)
+				return
+			}
+
+			if res.Command != cmd {
+				t.Errorf("command %s got the response of %s", cmd, res.Command)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestQmpEvents(t *testing.T) {
+	addr := serveFakeQmp(t, func(c *fakeQmpConn) {
+		req, ok := c.next()
+
+		if !ok {
+			return
+		}
+
+		c.event("STOP")
+		c.reply(req, nil)
+
+		c.next()
+	})
+
+	c, err := DialQmp(context.Background(), addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := c.Events()
+
+	if err := c.Execute(context.Background(), "stop", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ev := <-events:
+		if ev.Event != "STOP" {
+			t.Fatalf("got event %s, want STOP", ev.Event)
+		}
+
+		if want := time.Unix(1700000000, 500000); !ev.Timestamp.Equal(want) {
+			t.Fatalf("got timestamp %s, want %s", ev.Timestamp, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+
+	c.Close()
+
+	// The channel is closed with the connection
+	for range events {
+	}
+}
+
+func TestQmpQuit(t *testing.T) {
+	addr := serveFakeQmp(t, func(c *fakeQmpConn) {
+		req, ok := c.next()
+
+		if !ok || req.Execute != "quit" {
+			t.Errorf("got command %+v, want quit", req)
+		}
+
+		// QEMU exits without responding
+		c.conn.Close()
+	})
+
+	m := &Machine{Name: "test", qmpAddr: addr}
+
+	if err := m.Quit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other commands report the closed connection
+	addr = serveFakeQmp(t, func(c *fakeQmpConn) {
+		c.next()
+	})
+
+	m.qmpAddr = addr
+
+	err := m.Powerdown(context.Background())
+
+	if err == nil || errors.Is(err, ErrQmpClosed) {
+		t.Fatalf("expected a read error, got %v", err)
+	}
+}
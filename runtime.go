@@ -0,0 +1,199 @@
+package fog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+// ProjectState records the process running a project's machines, so other fog commands can find them.
+type ProjectState struct {
+	// Pid is the process running the machines, which is the supervisor when detached
+	Pid int
+	// Detached is true if the machines are run by a background supervisor
+	Detached bool
+	// Log is the log file of a detached project
+	Log string `json:",omitempty"`
+	// Started is the time the machines were started, which is zero while they are starting
+	Started time.Time
+}
+
+// Project returns the record of the process running the project's machines.
+// It returns nil if the project is not running.
+func (s *ProjectStore) Project() (*ProjectState, error) {
+	p := path.Join(s.runtimeDir, "project.json")
+
+	st := &ProjectState{}
+
+	if err := readJSON(p, st); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading project state: %w", err)
+	}
+
+	// The process may have died without removing its record
+	if !processAlive(st.Pid) {
+		os.Remove(p)
+
+		return nil, nil
+	}
+
+	return st, nil
+}
+
+// SetProject records the process running the project's machines.
+// It fails if another live process is already recorded.
+func (s *ProjectStore) SetProject(ctx context.Context, st *ProjectState) error {
+	unlock, err := lockFile(ctx, path.Join(s.runtimeDir, "project.lock"))
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	cur, err := s.Project()
+
+	if err != nil {
+		return err
+	}
+
+	if cur != nil && cur.Pid != st.Pid {
+		return fmt.Errorf("project is already running (pid %d)", cur.Pid)
+	}
+
+	return writeJSON(path.Join(s.runtimeDir, "project.json"), st)
+}
+
+// ClearProject removes the record of the process running the project's machines.
+func (s *ProjectStore) ClearProject(ctx context.Context) error {
+	unlock, err := lockFile(ctx, path.Join(s.runtimeDir, "project.lock"))
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	err = os.Remove(path.Join(s.runtimeDir, "project.json"))
+
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("removing project state: %w", err)
+	}
+
+	return nil
+}
+
+// machineRuntime is the part of a machine's state describing its process,
+// kept in the runtime directory.
+type machineRuntime struct {
+	Pid         int           `json:",omitempty"`
+	PidStart    uint64        `json:",omitempty"`
+	Socket      string        `json:",omitempty"`
+	QmpSocket   string        `json:",omitempty"`
+	Ports       []string      `json:",omitempty"`
+	StopTimeout time.Duration `json:",omitempty"`
+	Status      string
+	CloudInit   string    `json:",omitempty"`
+	Started     time.Time `json:",omitempty"`
+}
+
+// runtimeOf returns the runtime part of a machine's state.
+func runtimeOf(st *MachineState) *machineRuntime {
+	return &machineRuntime{
+		Pid:         st.Pid,
+		PidStart:    st.PidStart,
+		Socket:      st.Socket,
+		QmpSocket:   st.QmpSocket,
+		Ports:       st.Ports,
+		StopTimeout: st.StopTimeout,
+		Status:      st.Status,
+		CloudInit:   st.CloudInit,
+		Started:     st.Started,
+	}
+}
+
+// apply sets the runtime part of a machine's state.
+func (rt *machineRuntime) apply(st *MachineState) {
+	st.Pid = rt.Pid
+	st.PidStart = rt.PidStart
+	st.Socket = rt.Socket
+	st.QmpSocket = rt.QmpSocket
+	st.Ports = rt.Ports
+	st.StopTimeout = rt.StopTimeout
+	st.Status = rt.Status
+	st.CloudInit = rt.CloudInit
+	st.Started = rt.Started
+}
+
+// machineRuntimePath returns the path of a machine's runtime record.
+func (s *ProjectStore) machineRuntimePath(name string) string {
+	return path.Join(s.runtimeDir, "machines", name+".json")
+}
+
+// machineRuntime reads the runtime record of a machine. Machines which haven't
+// run since they were created or the host booted have no record, and are
+// reported as created.
+func (s *ProjectStore) machineRuntime(name string) (*machineRuntime, error) {
+	rt := &machineRuntime{}
+
+	if err := readJSON(s.machineRuntimePath(name), rt); errors.Is(err, fs.ErrNotExist) {
+		return &machineRuntime{Status: MachineCreated}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading runtime state of machine %s: %w", name, err)
+	}
+
+	return rt, nil
+}
+
+// processAlive reports whether a process exists.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	err := syscall.Kill(pid, 0)
+
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// sameProcess reports whether a process is alive and is still the one which
+// started at the given time. It fails if that can't be confirmed.
+func sameProcess(pid int, started uint64) (bool, error) {
+	if !processAlive(pid) {
+		return false, nil
+	}
+
+	if started == 0 {
+		return false, fmt.Errorf("start time of process %d is unknown", pid)
+	}
+
+	cur, err := processStartTime(pid)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("reading start time of process %d: %w", pid, err)
+	}
+
+	return cur == started, nil
+}
+
+// processRunning reports whether a process is alive, telling it apart from a
+// later process reusing its PID if its start time is known.
+func processRunning(pid int, started uint64) bool {
+	same, err := sameProcess(pid, started)
+
+	if err != nil {
+		return processAlive(pid)
+	}
+
+	return same
+}
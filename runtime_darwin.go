@@ -0,0 +1,26 @@
+package fog
+
+import (
+	"io/fs"
+
+	"golang.org/x/sys/unix"
+)
+
+// processStartTime returns the start time of a process in microseconds since
+// the epoch, which tells it apart from later processes reusing its PID.
+func processStartTime(pid int) (uint64, error) {
+	procs, err := unix.SysctlKinfoProcSlice("kern.proc.pid", pid)
+
+	if err != nil {
+		return 0, err
+	}
+
+	// The kernel returns no entries for processes which don't exist
+	if len(procs) == 0 {
+		return 0, fs.ErrNotExist
+	}
+
+	t := procs[0].Proc.P_starttime
+
+	return uint64(t.Sec)*1e6 + uint64(t.Usec), nil
+}
@@ -0,0 +1,35 @@
+package fog
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// processStartTime returns the start time of a process in clock ticks after
+// boot, which tells it apart from later processes reusing its PID.
+func processStartTime(pid int) (uint64, error) {
+	buf, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+
+	if err != nil {
+		return 0, err
+	}
+
+	// The command name in parentheses may contain spaces
+	i := bytes.LastIndexByte(buf, ')')
+
+	if i < 0 {
+		return 0, fmt.Errorf("malformed status of process %d", pid)
+	}
+
+	// The start time is the 22nd field, the 20th after the command name
+	fields := strings.Fields(string(buf[i+1:]))
+
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("malformed status of process %d", pid)
+	}
+
+	return strconv.ParseUint(fields[19], 10, 64)
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package fog
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// processStartTime would return the start time of a process, which isn't
+// supported on this platform, so processes can't be told apart from later ones
+// reusing their PID.
+func processStartTime(pid int) (uint64, error) {
+	return 0, fmt.Errorf("process start times are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,383 @@
+package fog
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// s3Scheme prefixes image URLs pointing to S3 objects
+	s3Scheme = "s3://"
+	// s3UnsignedPayload is the payload hash of requests whose body is not signed
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// s3Provider provides images from an S3 compatible object store.
+//
+// YAML manifests are stored below the prefix of a bucket. Their URLs are
+// either s3://bucket/key URLs or keys relative to the manifest.
+type s3Provider struct {
+	client *http.Client
+	bucket string
+	prefix string
+	// endpoint is the URL of an S3 compatible service, which is accessed with
+	// path style URLs. Virtual hosted AWS URLs are used if it is empty.
+	endpoint     string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func newS3Provider(conf ProviderConfig, client *http.Client) (ImageProvider, error) {
+	bucket, prefix, err := parseS3Url(conf.Url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p := envS3Provider(client)
+
+	p.bucket = bucket
+	p.prefix = prefix
+	p.endpoint = strings.TrimSuffix(conf.Endpoint, "/")
+
+	if conf.Region != "" {
+		p.region = conf.Region
+	}
+
+	if conf.AccessKey != "" || conf.SecretKey != "" {
+		p.accessKey = conf.AccessKey
+		p.secretKey = conf.SecretKey
+		p.sessionToken = ""
+	}
+
+	return p, nil
+}
+
+// envS3Provider returns an S3 provider for AWS configured by the standard environment variables.
+func envS3Provider(client *http.Client) *s3Provider {
+	region := os.Getenv("AWS_REGION")
+
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &s3Provider{
+		client:       client,
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// parseS3Url splits an s3://bucket/key URL into the bucket and key.
+func parseS3Url(raw string) (string, string, error) {
+	s, ok := strings.CutPrefix(raw, s3Scheme)
+
+	if !ok {
+		return "", "", fmt.Errorf("invalid S3 URL '%s'", raw)
+	}
+
+	bucket, key, _ := strings.Cut(s, "/")
+
+	if bucket == "" {
+		return "", "", fmt.Errorf("S3 URL '%s' has no bucket", raw)
+	}
+
+	return bucket, key, nil
+}
+
+// s3ListResult is the response of the ListObjectsV2 API.
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (p *s3Provider) List(ctx context.Context) ([]*Image, error) {
+	var keys []string
+
+	query := url.Values{
+		"list-type": {"2"},
+	}
+
+	if p.prefix != "" {
+		query.Set("prefix", strings.TrimSuffix(p.prefix, "/")+"/")
+	}
+
+	for {
+		buf, err := p.get(ctx, p.bucket, "", query)
+
+		if err != nil {
+			return nil, fmt.Errorf("listing s3://%s/%s: %w", p.bucket, p.prefix, err)
+		}
+
+		res := s3ListResult{}
+
+		if err := xml.Unmarshal(buf, &res); err != nil {
+			return nil, fmt.Errorf("parsing object list: %w", err)
+		}
+
+		for _, c := range res.Contents {
+			if path.Ext(c.Key) == ".yaml" {
+				keys = append(keys, c.Key)
+			}
+		}
+
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			break
+		}
+
+		query.Set("continuation-token", res.NextContinuationToken)
+	}
+
+	sort.Strings(keys)
+
+	var imgs []*Image
+
+	for _, key := range keys {
+		buf, err := p.get(ctx, p.bucket, key, nil)
+
+		if err != nil {
+			return nil, fmt.Errorf("reading manifest %s: %w", key, err)
+		}
+
+		img := Image{}
+
+		if err := yaml.Unmarshal(buf, &img); err != nil {
+			return nil, fmt.Errorf("parsing YAML in %s: %w", key, err)
+		}
+
+		if img.Url != "" && !strings.Contains(img.Url, "://") {
+			img.Url = s3Scheme + p.bucket + "/" + path.Join(path.Dir(key), img.Url)
+		}
+
+		imgs = append(imgs, &img)
+	}
+
+	return imgs, nil
+}
+
+func (p *s3Provider) Resolve(ctx context.Context, name string, tag string, arch string) (*Image, error) {
+	imgs, err := p.List(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resolveFromList(imgs, name, tag, arch)
+}
+
+func (p *s3Provider) Fetch(ctx context.Context, img *Image, w io.Writer) error {
+	bucket, key, err := parseS3Url(img.Url)
+
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.do(ctx, bucket, key, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+
+	return err
+}
+
+// get reads an object, or lists a bucket if the key is empty.
+func (p *s3Provider) get(ctx context.Context, bucket string, key string, query url.Values) ([]byte, error) {
+	resp, err := p.do(ctx, bucket, key, query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+// do sends a signed GET request for an object and checks the response status.
+func (p *s3Provider) do(ctx context.Context, bucket string, key string, query url.Values) (*http.Response, error) {
+	var u string
+
+	if p.endpoint != "" {
+		u = p.endpoint + "/" + bucket + "/" + s3EscapePath(key)
+	} else {
+		u = "https://" + bucket + ".s3." + p.region + ".amazonaws.com/" + s3EscapePath(key)
+	}
+
+	if len(query) > 0 {
+		u += "?" + s3EscapeQuery(query)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	if p.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", p.sessionToken)
+	}
+
+	// Requests without credentials are sent anonymously for public buckets
+	if p.accessKey != "" {
+		signV4(req, p.accessKey, p.secretKey, p.region, "s3", time.Now())
+	}
+
+	client := p.client
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+
+		return nil, &httpStatusError{url: u, status: resp.Status, code: resp.StatusCode}
+	}
+
+	return resp, nil
+}
+
+// signV4 signs a request with AWS Signature Version 4.
+//
+// The host, range and x-amz-* headers are signed. The payload hash is taken
+// from the X-Amz-Content-Sha256 header.
+func signV4(req *http.Request, accessKey string, secretKey string, region string, service string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+
+		if k == "range" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+
+	var names []string
+
+	for k := range headers {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	// Query parameters must be sorted and encoded per RFC 3986
+	query, _ := url.ParseQuery(req.URL.RawQuery)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3EscapeQuery(query),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+
+	h := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+
+	key := []byte("AWS4" + secretKey)
+
+	for _, s := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+// s3EscapePath escapes each segment of an object key per RFC 3986.
+func s3EscapePath(key string) string {
+	segments := strings.Split(key, "/")
+
+	for i, s := range segments {
+		segments[i] = s3Escape(s)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// s3EscapeQuery encodes query parameters sorted by key per RFC 3986.
+func s3EscapeQuery(query url.Values) string {
+	var keys []string
+
+	for k := range query {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	var params []string
+
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+// s3Escape escapes all but the unreserved characters of RFC 3986.
+func s3Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
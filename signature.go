@@ -0,0 +1,364 @@
+package fog
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/charmbracelet/log"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Signature policies.
+const (
+	// SignatureRequire fails pulls of images without a valid signature
+	SignatureRequire = "require"
+	// SignatureWarn logs a warning for images with an invalid signature
+	SignatureWarn = "warn"
+	// SignatureOff skips signature verification
+	SignatureOff = "off"
+)
+
+// ImageSignature describes a vendor signature of an image.
+type ImageSignature struct {
+	// Type is the signature scheme: gpg, minisign or cosign
+	Type string
+	// Url is the location of the detached signature, which may be empty for clearsigned checksum files
+	Url string `yaml:",omitempty"`
+	// Checksums is the location of a signed checksum file listing the image.
+	// If set, the signature covers the checksum file instead of the image itself.
+	Checksums string `yaml:",omitempty"`
+	// Key references a trusted public key by file name in the keyring or by path
+	Key string
+}
+
+// verifySignature verifies the signature of a downloaded image file.
+//
+// The checksum is the verified SHA256 checksum of the file, or empty if it has
+// not been verified yet.
+func (r *ImageRepository) verifySignature(ctx context.Context, img *Image, file string, checksum string) error {
+	sig := img.Signature
+
+	key, err := os.ReadFile(r.keyPath(sig.Key))
+
+	if err != nil {
+		return fmt.Errorf("reading key %s: %w", sig.Key, err)
+	}
+
+	if sig.Checksums == "" {
+		if sig.Url == "" {
+			return errors.New("signature URL is required")
+		}
+
+		sigBuf, err := fetch(ctx, r.client, sig.Url)
+
+		if err != nil {
+			return fmt.Errorf("downloading signature: %w", err)
+		}
+
+		f, err := os.Open(file)
+
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+
+		return verifyDetached(sig.Type, key, f, sigBuf)
+	}
+
+	sums, err := fetch(ctx, r.client, sig.Checksums)
+
+	if err != nil {
+		return fmt.Errorf("downloading checksums: %w", err)
+	}
+
+	var signed []byte
+
+	if sig.Url == "" {
+		if sig.Type != "gpg" {
+			return errors.New("only gpg supports clearsigned checksum files")
+		}
+
+		signed, err = verifyClearsigned(key, sums)
+
+		if err != nil {
+			return err
+		}
+	} else {
+		sigBuf, err := fetch(ctx, r.client, sig.Url)
+
+		if err != nil {
+			return fmt.Errorf("downloading signature: %w", err)
+		}
+
+		if err := verifyDetached(sig.Type, key, bytes.NewReader(sums), sigBuf); err != nil {
+			return err
+		}
+
+		signed = sums
+	}
+
+	if checksum == "" {
+		if checksum, err = fileChecksum(file); err != nil {
+			return fmt.Errorf("computing checksum: %w", err)
+		}
+	}
+
+	// Only the signed content is trusted, so the checksum must be listed in it
+	for _, s := range parseChecksums(signed) {
+		if s == checksum {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("checksum %s is not listed in the signed checksums", checksum)
+}
+
+// keyPath resolves a key reference to a file path.
+func (r *ImageRepository) keyPath(key string) string {
+	if filepath.IsAbs(key) || strings.ContainsRune(key, filepath.Separator) {
+		return key
+	}
+
+	return filepath.Join(r.keyring, key)
+}
+
+// signatureVerifier returns the hook verifying image signatures before a download is accepted,
+// or nil if the image should not be verified.
+func (r *ImageRepository) signatureVerifier(ctx context.Context, img *Image, verifiedChecksum string) (func(string) error, error) {
+	switch r.signaturePolicy {
+	case SignatureOff:
+		return nil, nil
+	case "", SignatureWarn, SignatureRequire:
+	default:
+		return nil, fmt.Errorf("unknown signature policy '%s'", r.signaturePolicy)
+	}
+
+	if img.Signature == nil {
+		// The checksums of built-in manifests are as trustworthy as the binary itself
+		if r.signaturePolicy == SignatureRequire && !img.builtin {
+			return nil, fmt.Errorf("image %s is not signed", img.Name)
+		}
+
+		return nil, nil
+	}
+
+	verify := func(file string) error {
+		err := r.verifySignature(ctx, img, file, verifiedChecksum)
+
+		if err == nil {
+			log.Debug("Verified image signature", "image", img.Name, "type", img.Signature.Type)
+
+			return nil
+		}
+
+		if r.signaturePolicy == SignatureRequire {
+			return fmt.Errorf("verifying signature: %w", err)
+		}
+
+		log.Warn("Image signature verification failed", "image", img.Name, "error", err)
+
+		return nil
+	}
+
+	return verify, nil
+}
+
+// verifyDetached verifies a detached signature of a message.
+func verifyDetached(typ string, key []byte, msg io.Reader, sig []byte) error {
+	switch typ {
+	case "gpg":
+		return verifyGpg(key, msg, sig)
+	case "minisign":
+		return verifyMinisign(key, msg, sig)
+	case "cosign":
+		return verifyCosign(key, msg, sig)
+	default:
+		return fmt.Errorf("unknown signature type '%s'", typ)
+	}
+}
+
+// readGpgKeyRing reads an armored or binary GPG public key ring.
+func readGpgKeyRing(key []byte) (openpgp.EntityList, error) {
+	if bytes.Contains(key, []byte("-----BEGIN PGP")) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(key))
+	}
+
+	return openpgp.ReadKeyRing(bytes.NewReader(key))
+}
+
+func verifyGpg(key []byte, msg io.Reader, sig []byte) error {
+	keyring, err := readGpgKeyRing(key)
+
+	if err != nil {
+		return fmt.Errorf("reading GPG key: %w", err)
+	}
+
+	if bytes.Contains(sig, []byte("-----BEGIN PGP")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, msg, bytes.NewReader(sig), nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keyring, msg, bytes.NewReader(sig), nil)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid GPG signature: %w", err)
+	}
+
+	return nil
+}
+
+// verifyClearsigned verifies a clearsigned GPG message and returns the signed content.
+func verifyClearsigned(key []byte, msg []byte) ([]byte, error) {
+	keyring, err := readGpgKeyRing(key)
+
+	if err != nil {
+		return nil, fmt.Errorf("reading GPG key: %w", err)
+	}
+
+	b, _ := clearsign.Decode(msg)
+
+	if b == nil {
+		return nil, errors.New("checksum file is not clearsigned")
+	}
+
+	if _, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(b.Bytes), b.ArmoredSignature.Body, nil); err != nil {
+		return nil, fmt.Errorf("invalid GPG signature: %w", err)
+	}
+
+	return b.Plaintext, nil
+}
+
+// minisignLines returns the non-comment lines of a minisign key or signature file.
+func minisignLines(buf []byte) []string {
+	var lines []string
+
+	for _, l := range strings.Split(string(buf), "\n") {
+		l = strings.TrimSpace(l)
+
+		if l == "" || strings.HasPrefix(l, "untrusted comment:") {
+			continue
+		}
+
+		lines = append(lines, l)
+	}
+
+	return lines
+}
+
+func verifyMinisign(key []byte, msg io.Reader, sig []byte) error {
+	keyLines := minisignLines(key)
+
+	if len(keyLines) == 0 {
+		return errors.New("invalid minisign key")
+	}
+
+	pk, err := base64.StdEncoding.DecodeString(keyLines[0])
+
+	if err != nil || len(pk) != 42 || string(pk[:2]) != "Ed" {
+		return errors.New("invalid minisign key")
+	}
+
+	sigLines := minisignLines(sig)
+
+	if len(sigLines) < 3 || !strings.HasPrefix(sigLines[1], "trusted comment: ") {
+		return errors.New("invalid minisign signature")
+	}
+
+	s, err := base64.StdEncoding.DecodeString(sigLines[0])
+
+	if err != nil || len(s) != 74 {
+		return errors.New("invalid minisign signature")
+	}
+
+	if !bytes.Equal(s[2:10], pk[2:10]) {
+		return errors.New("minisign signature was made with a different key")
+	}
+
+	pub := ed25519.PublicKey(pk[10:])
+
+	// Legacy signatures cover the whole file, which would have to be read into memory
+	switch string(s[:2]) {
+	case "ED":
+	case "Ed":
+		return errors.New("legacy minisign signatures are not supported, sign with a prehashed signature")
+	default:
+		return errors.New("unsupported minisign signature algorithm")
+	}
+
+	h, _ := blake2b.New512(nil)
+
+	if _, err := io.Copy(h, msg); err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(pub, h.Sum(nil), s[10:]) {
+		return errors.New("invalid minisign signature")
+	}
+
+	// The trusted comment is covered by a second, global signature
+	global, err := base64.StdEncoding.DecodeString(sigLines[2])
+
+	if err != nil {
+		return errors.New("invalid minisign signature")
+	}
+
+	comment := strings.TrimPrefix(sigLines[1], "trusted comment: ")
+
+	if !ed25519.Verify(pub, append(append([]byte{}, s[10:]...), comment...), global) {
+		return errors.New("invalid minisign trusted comment signature")
+	}
+
+	return nil
+}
+
+func verifyCosign(key []byte, msg io.Reader, sig []byte) error {
+	block, _ := pem.Decode(key)
+
+	if block == nil {
+		return errors.New("invalid cosign key")
+	}
+
+	pk, err := x509.ParsePKIXPublicKey(block.Bytes)
+
+	if err != nil {
+		return fmt.Errorf("parsing cosign key: %w", err)
+	}
+
+	pub, ok := pk.(*ecdsa.PublicKey)
+
+	if !ok {
+		return errors.New("cosign key is not an ECDSA key")
+	}
+
+	s, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+
+	if err != nil {
+		return fmt.Errorf("decoding cosign signature: %w", err)
+	}
+
+	h := sha256.New()
+
+	if _, err := io.Copy(h, msg); err != nil {
+		return err
+	}
+
+	if !ecdsa.VerifyASN1(pub, h.Sum(nil), s) {
+		return errors.New("invalid cosign signature")
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package fog
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"golang.org/x/crypto/blake2b"
+)
+
+// testGpgKey generates a GPG key and returns it with its armored public key.
+func testGpgKey(t *testing.T) (*openpgp.Entity, []byte) {
+	t.Helper()
+
+	e, err := openpgp.NewEntity("fog", "", "fog@example.com", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pub bytes.Buffer
+
+	w, err := armor.Encode(&pub, openpgp.PublicKeyType, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+
+	w.Close()
+
+	return e, pub.Bytes()
+}
+
+func TestVerifyGpg(t *testing.T) {
+	e, key := testGpgKey(t)
+
+	msg := "fog image"
+
+	var sig bytes.Buffer
+
+	if err := openpgp.ArmoredDetachSign(&sig, e, strings.NewReader(msg), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyDetached("gpg", key, strings.NewReader(msg), sig.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyDetached("gpg", key, strings.NewReader("tampered"), sig.Bytes()); err == nil {
+		t.Fatal("verified a signature of different content")
+	}
+}
+
+func TestVerifyClearsigned(t *testing.T) {
+	e, key := testGpgKey(t)
+
+	sums := sha256Hex("image") + "  image.qcow2\n"
+
+	var signed bytes.Buffer
+
+	w, err := clearsign.Encode(&signed, e.PrivateKey, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Write([]byte(sums))
+	w.Close()
+
+	plain, err := verifyClearsigned(key, signed.Bytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(plain) != strings.TrimSuffix(sums, "\n") && string(plain) != sums {
+		t.Fatalf("got signed content %q, want %q", plain, sums)
+	}
+
+	tampered := bytes.Replace(signed.Bytes(), []byte("image.qcow2"), []byte("other.qcow2"), 1)
+
+	if _, err := verifyClearsigned(key, tampered); err == nil {
+		t.Fatal("verified tampered clearsigned content")
+	}
+}
+
+// minisignFiles returns a minisign public key and a signature of a message
+// using the given algorithm, "ED" for prehashed or "Ed" for legacy signatures.
+func minisignFiles(t *testing.T, msg string, alg string) ([]byte, []byte) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	pk := append(append([]byte("Ed"), keyID...), pub...)
+
+	signed := []byte(msg)
+
+	if alg == "ED" {
+		h := blake2b.Sum512(signed)
+		signed = h[:]
+	}
+
+	sig := ed25519.Sign(priv, signed)
+
+	comment := "timestamp:0"
+
+	global := ed25519.Sign(priv, append(append([]byte{}, sig...), comment...))
+
+	key := "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(pk) + "\n"
+
+	sigFile := "untrusted comment: signature\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte(alg), keyID...), sig...)) + "\n" +
+		"trusted comment: " + comment + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n"
+
+	return []byte(key), []byte(sigFile)
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	msg := "fog image"
+
+	key, sig := minisignFiles(t, msg, "ED")
+
+	if err := verifyDetached("minisign", key, strings.NewReader(msg), sig); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyDetached("minisign", key, strings.NewReader("tampered"), sig); err == nil {
+		t.Fatal("verified a signature of different content")
+	}
+}
+
+func TestVerifyMinisignRejectsLegacy(t *testing.T) {
+	msg := "fog image"
+
+	key, sig := minisignFiles(t, msg, "Ed")
+
+	err := verifyDetached("minisign", key, strings.NewReader(msg), sig)
+
+	if err == nil || !strings.Contains(err.Error(), "legacy") {
+		t.Fatalf("expected legacy signatures to be rejected, got %v", err)
+	}
+}
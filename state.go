@@ -0,0 +1,287 @@
+package fog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/adrg/xdg"
+)
+
+// Machine statuses recorded in the project state store.
+const (
+	MachineCreated = "created"
+	MachineRunning = "running"
+	// MachineStopping is the status of a machine being stopped by another fog process
+	MachineStopping = "stopping"
+	MachineStopped  = "stopped"
+	// MachineExited is the status of a machine whose process died without being stopped
+	MachineExited = "exited"
+)
+
+// Cloud-init statuses recorded in the project state store.
+const (
+	CloudInitRunning = "running"
+	CloudInitDone    = "done"
+)
+
+// projectNamePattern matches valid explicit project names.
+var projectNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// MachineState records the state of a machine.
+//
+// The machine's identity and disks are kept in the state directory, since they
+// outlive the machine's process. Everything else describes the running process
+// and is kept in the runtime directory, so it is gone after a reboot.
+type MachineState struct {
+	Name string
+	// ID is the machine's stable identifier, which is kept across restarts
+	ID string
+	// Image is the image reference of the machine
+	Image string
+	// Pid is the machine's QEMU process
+	Pid int `json:",omitempty"`
+	// PidStart is the start time of the QEMU process, which tells it apart from
+	// a later process reusing its PID
+	PidStart uint64 `json:",omitempty"`
+	// Socket is the machine's serial console socket
+	Socket string `json:",omitempty"`
+	// QmpSocket is the machine's QMP socket
+	QmpSocket string   `json:",omitempty"`
+	Ports     []string `json:",omitempty"`
+	// Disks are the paths of the machine's disks, starting with the boot disk
+	Disks []string `json:",omitempty"`
+	// StopTimeout is how long the machine gets to power off
+	StopTimeout time.Duration `json:",omitempty"`
+	Status      string
+	// CloudInit is the cloud-init status of a running machine, as seen on its console
+	CloudInit string `json:",omitempty"`
+	// Started is the time the machine was last started
+	Started time.Time `json:",omitempty"`
+}
+
+// machineRecord is the part of a machine's state kept in the state directory.
+type machineRecord struct {
+	Name  string
+	ID    string
+	Image string
+	Disks []string `json:",omitempty"`
+}
+
+// ProjectStore persists the state of a project and its machines.
+//
+// State which outlives the machines, such as their IDs and disks, is kept in
+// the XDG state directory. The records of running processes, the machines'
+// and the one running them, are kept in the XDG runtime directory. Records are
+// guarded by file locks, so several fog processes can use the store at the
+// same time.
+type ProjectStore struct {
+	id         string
+	stateDir   string
+	runtimeDir string
+}
+
+// OpenProjectStore returns the state store of a project.
+//
+// The project is identified by its name if set, or else by the name and
+// absolute path of its directory, so projects with the same directory name
+// don't collide.
+func OpenProjectStore(projectDir string, name string) (*ProjectStore, error) {
+	id := name
+
+	if id == "" {
+		dir, err := filepath.Abs(projectDir)
+
+		if err != nil {
+			return nil, fmt.Errorf("resolving project directory: %w", err)
+		}
+
+		h := sha256.Sum256([]byte(dir))
+
+		id = filepath.Base(dir) + "-" + hex.EncodeToString(h[:])[:12]
+	} else if !projectNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid project name '%s'", name)
+	}
+
+	return &ProjectStore{
+		id:         id,
+		stateDir:   path.Join(xdg.StateHome, "fog", "projects", id),
+		runtimeDir: path.Join(xdg.RuntimeDir, "fog", "projects", id),
+	}, nil
+}
+
+// ID returns the identity of the project.
+func (s *ProjectStore) ID() string {
+	return s.id
+}
+
+// StateDir returns the directory holding the state of the project, such as persistent disks.
+func (s *ProjectStore) StateDir() string {
+	return s.stateDir
+}
+
+// LogPath returns the log file of the project's background supervisor.
+func (s *ProjectStore) LogPath() string {
+	return path.Join(s.stateDir, "fog.log")
+}
+
+// machineDir returns the state directory of a machine.
+func (s *ProjectStore) machineDir(name string) string {
+	return path.Join(s.stateDir, "machines", name)
+}
+
+// Machine returns the state of a machine, or nil if it has no state.
+func (s *ProjectStore) Machine(name string) (*MachineState, error) {
+	rec := &machineRecord{}
+
+	if err := readJSON(path.Join(s.machineDir(name), "machine.json"), rec); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading state of machine %s: %w", name, err)
+	}
+
+	rt, err := s.machineRuntime(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	st := &MachineState{
+		Name:  rec.Name,
+		ID:    rec.ID,
+		Image: rec.Image,
+		Disks: rec.Disks,
+	}
+
+	rt.apply(st)
+
+	// A running machine whose process is gone has crashed or was killed
+	if !processRunning(st.Pid, st.PidStart) {
+		switch st.Status {
+		case MachineRunning:
+			st.Status = MachineExited
+		case MachineStopping:
+			st.Status = MachineStopped
+		}
+	}
+
+	return st, nil
+}
+
+// Machines returns the state of all machines of the project, sorted by name.
+func (s *ProjectStore) Machines() ([]*MachineState, error) {
+	entries, err := os.ReadDir(path.Join(s.stateDir, "machines"))
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading machine states: %w", err)
+	}
+
+	var machines []*MachineState
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		st, err := s.Machine(e.Name())
+
+		if err != nil {
+			return nil, err
+		}
+
+		if st != nil {
+			machines = append(machines, st)
+		}
+	}
+
+	sort.Slice(machines, func(i, j int) bool {
+		return machines[i].Name < machines[j].Name
+	})
+
+	return machines, nil
+}
+
+// UpdateMachine updates the state of a machine while holding its lock.
+// A new state is passed to the update function if the machine has none yet.
+func (s *ProjectStore) UpdateMachine(ctx context.Context, name string, update func(st *MachineState) error) error {
+	dir := s.machineDir(name)
+
+	unlock, err := lockFile(ctx, path.Join(dir, "machine.lock"))
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	st, err := s.Machine(name)
+
+	if err != nil {
+		return err
+	}
+
+	if st == nil {
+		st = &MachineState{Name: name, Status: MachineCreated}
+	}
+
+	if err := update(st); err != nil {
+		return err
+	}
+
+	rec := &machineRecord{
+		Name:  st.Name,
+		ID:    st.ID,
+		Image: st.Image,
+		Disks: st.Disks,
+	}
+
+	if err := writeJSON(path.Join(dir, "machine.json"), rec); err != nil {
+		return err
+	}
+
+	return writeJSON(s.machineRuntimePath(name), runtimeOf(st))
+}
+
+// readJSON reads a JSON file.
+func readJSON(p string, v interface{}) error {
+	buf, err := os.ReadFile(p)
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buf, v)
+}
+
+// writeJSON writes a JSON file, replacing it atomically so readers never see a partial file.
+func writeJSON(p string, v interface{}) error {
+	if err := os.MkdirAll(path.Dir(p), 0o755); err != nil {
+		return fmt.Errorf("creating state directory: %w", err)
+	}
+
+	buf, err := json.MarshalIndent(v, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(p+".tmp", buf, 0o644); err != nil {
+		return fmt.Errorf("writing %s: %w", path.Base(p), err)
+	}
+
+	return os.Rename(p+".tmp", p)
+}
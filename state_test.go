@@ -0,0 +1,211 @@
+package fog
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestStore returns a project store using temporary directories.
+func newTestStore(t *testing.T) *ProjectStore {
+	t.Helper()
+
+	return &ProjectStore{
+		id:         "test",
+		stateDir:   t.TempDir(),
+		runtimeDir: t.TempDir(),
+	}
+}
+
+func TestSetProjectRejectsOtherProcess(t *testing.T) {
+	s := newTestStore(t)
+
+	other := exec.Command("sleep", "60")
+
+	if err := other.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		other.Process.Kill()
+		other.Wait()
+	}()
+
+	if err := s.SetProject(context.Background(), &ProjectState{Pid: other.Process.Pid}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := s.SetProject(context.Background(), &ProjectState{Pid: os.Getpid()})
+
+	if err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Fatalf("expected the project to be running already, got %v", err)
+	}
+
+	// The recorded process may update its own record
+	if err := s.SetProject(context.Background(), &ProjectState{Pid: other.Process.Pid, Started: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestControlWhileStarting(t *testing.T) {
+	s := newTestStore(t)
+
+	if err := s.SetProject(context.Background(), &ProjectState{Pid: os.Getpid()}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := s.StartMachine(context.Background(), "one")
+
+	if err == nil || !strings.Contains(err.Error(), "still starting") {
+		t.Fatalf("expected the project to be starting, got %v", err)
+	}
+}
+
+func TestMachineStateSplit(t *testing.T) {
+	s := newTestStore(t)
+
+	err := s.UpdateMachine(context.Background(), "one", func(st *MachineState) error {
+		st.ID = "id"
+		st.Image = "debian:12"
+		st.Disks = []string{"/disks/root.qcow2"}
+		st.Pid = os.Getpid()
+		st.Socket = "/run/one.sock"
+		st.Status = MachineRunning
+		st.Started = time.Now()
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := os.ReadFile(path.Join(s.machineDir("one"), "machine.json"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, field := range []string{"Pid", "Socket", "Status", "Started"} {
+		if strings.Contains(string(buf), `"`+field+`"`) {
+			t.Errorf("runtime field %s is kept in the state directory", field)
+		}
+	}
+
+	st, err := s.Machine("one")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st.ID != "id" || st.Pid != os.Getpid() || st.Status != MachineRunning || len(st.Disks) != 1 {
+		t.Fatalf("unexpected state %+v", st)
+	}
+
+	// The runtime directory is cleared by a reboot
+	if err := os.RemoveAll(s.runtimeDir); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err = s.Machine("one")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st.ID != "id" || st.Pid != 0 || st.Status != MachineCreated || len(st.Disks) != 1 {
+		t.Fatalf("unexpected state after reboot %+v", st)
+	}
+}
+
+func TestKillProcessConfirmsIdentity(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	exited := make(chan struct{})
+
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	defer cmd.Process.Kill()
+
+	pid := cmd.Process.Pid
+
+	started, err := processStartTime(pid)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := killProcess(pid, 0); err == nil {
+		t.Fatal("expected a process with an unknown start time not to be killed")
+	}
+
+	// A process started at another time merely reuses the PID
+	if err := killProcess(pid, started+1); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-exited:
+		t.Fatal("killed a process reusing the PID")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := killProcess(pid, started); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("process wasn't killed")
+	}
+}
+
+func TestRemoveMachineWhileProjectRunning(t *testing.T) {
+	s := newTestStore(t)
+
+	err := s.UpdateMachine(context.Background(), "one", func(st *MachineState) error {
+		st.ID = "id"
+		st.Status = MachineStopped
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetProject(context.Background(), &ProjectState{Pid: os.Getpid()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The running process would record the machine again once it exits
+	if _, err := s.RemoveMachine(context.Background(), "one"); err == nil || !strings.Contains(err.Error(), "still running") {
+		t.Fatalf("expected the project to be running, got %v", err)
+	}
+
+	if err := s.ClearProject(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := s.RemoveMachine(context.Background(), "one")
+
+	if err != nil || !removed {
+		t.Fatalf("expected the machine to be removed, got %v, %v", removed, err)
+	}
+
+	if st, err := s.Machine("one"); err != nil || st != nil {
+		t.Fatalf("expected no state, got %+v, %v", st, err)
+	}
+}
@@ -0,0 +1,319 @@
+package fog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LocalImage is an image file in the local image store.
+type LocalImage struct {
+	Checksum string
+	Path     string
+	Size     int64
+	// Pulled is the time the image was stored
+	Pulled time.Time
+}
+
+// Images returns the effective image manifests.
+//
+// Tags overridden by a manifest with higher precedence are removed, and
+// manifests without any remaining tags are omitted. Images with upstream
+// metadata are returned once per resolved build recorded in the lock file, and
+// once more for any tags that have not been resolved yet.
+func (r *ImageRepository) Images() ([]*Image, error) {
+	r.lockMu.Lock()
+	lock, err := r.readLock()
+	r.lockMu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+
+	var imgs []*Image
+
+	for _, img := range r.imgs {
+		var tags []string
+
+		// Unbuilt images don't override the manifests registered when they are built
+		unbuilt := img.Build != nil && img.Checksum == ""
+
+		for _, t := range img.Tags {
+			key := lockKey(img.Name, t, img.Arch)
+
+			if seen[key] {
+				continue
+			}
+
+			if !unbuilt {
+				seen[key] = true
+			}
+
+			tags = append(tags, t)
+		}
+
+		if len(tags) == 0 {
+			continue
+		}
+
+		if img.Upstream == nil {
+			visible := *img
+			visible.Tags = tags
+
+			imgs = append(imgs, &visible)
+
+			continue
+		}
+
+		// Group the tags by resolved build, keeping the order of the tags
+		var builds []*Image
+
+		byChecksum := make(map[string]*Image)
+
+		for _, t := range tags {
+			locked := lock.Images[lockKey(img.Name, t, img.Arch)]
+
+			sum := ""
+
+			if locked != nil {
+				sum = locked.Checksum
+			}
+
+			b, ok := byChecksum[sum]
+
+			if !ok {
+				res := *img
+				res.Tags = nil
+
+				if locked != nil {
+					res.Url = locked.Url
+					res.Checksum = locked.Checksum
+				}
+
+				b = &res
+				byChecksum[sum] = b
+				builds = append(builds, b)
+			}
+
+			b.Tags = append(b.Tags, t)
+		}
+
+		imgs = append(imgs, builds...)
+	}
+
+	return imgs, nil
+}
+
+// LocalImages returns the images in the local image store.
+func (r *ImageRepository) LocalImages() ([]*LocalImage, error) {
+	dir := path.Join(r.dataDir, "images")
+
+	entries, err := os.ReadDir(dir)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading image directory: %w", err)
+	}
+
+	var locals []*LocalImage
+
+	for _, e := range entries {
+		if e.IsDir() || path.Ext(e.Name()) != ".qcow2" {
+			continue
+		}
+
+		fi, err := e.Info()
+
+		if err != nil {
+			return nil, fmt.Errorf("reading image file info: %w", err)
+		}
+
+		locals = append(locals, &LocalImage{
+			Checksum: strings.TrimSuffix(e.Name(), ".qcow2"),
+			Path:     path.Join(dir, e.Name()),
+			Size:     fi.Size(),
+			Pulled:   fi.ModTime(),
+		})
+	}
+
+	sort.Slice(locals, func(i, j int) bool {
+		return locals[i].Pulled.After(locals[j].Pulled)
+	})
+
+	return locals, nil
+}
+
+// Remove deletes an image and any partial downloads of it from the local image store.
+// It returns false if the image was not stored. Images backing a persistent disk can't be removed.
+func (r *ImageRepository) Remove(ctx context.Context, checksum string) (bool, error) {
+	backing, err := diskBackingImages()
+
+	if err != nil {
+		return false, err
+	}
+
+	if backing[checksum] {
+		return false, fmt.Errorf("image %s is used by a persistent machine disk", ShortChecksum(checksum))
+	}
+
+	unlock, err := r.lockImage(ctx, checksum)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer unlock()
+
+	base := r.ImagePath(&Image{Checksum: checksum})
+
+	removed := false
+
+	for _, p := range []string{base, base + ".tmp", base + ".download", base + ".download.tmp", base + ".raw"} {
+		err := os.Remove(p)
+
+		if err == nil {
+			if p == base {
+				removed = true
+			}
+
+			continue
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return removed, fmt.Errorf("removing image: %w", err)
+		}
+	}
+
+	return removed, nil
+}
+
+// Prune deletes all stored images which are not referenced by a manifest, a provider, the lock file of any project or a persistent disk.
+// Registry images used by machines have no manifest, so they are kept through the lock file.
+// The removed images are returned.
+func (r *ImageRepository) Prune(ctx context.Context) ([]*LocalImage, error) {
+	r.lockMu.Lock()
+	lock, err := r.readLock()
+	r.lockMu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[string]bool)
+
+	for _, img := range r.imgs {
+		if img.Checksum != "" {
+			referenced[img.Checksum] = true
+		}
+	}
+
+	for _, locked := range lock.Images {
+		referenced[locked.Checksum] = true
+	}
+
+	// Images pinned by other projects must be kept too
+	locked, err := r.lockedChecksums()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for sum := range locked {
+		referenced[sum] = true
+	}
+
+	// Persistent disks are overlays which can't be used without their backing image
+	backing, err := diskBackingImages()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for sum := range backing {
+		referenced[sum] = true
+	}
+
+	pimgs, err := r.ProviderImages(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, img := range pimgs {
+		if img.Checksum != "" {
+			referenced[img.Checksum] = true
+		}
+	}
+
+	locals, err := r.LocalImages()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var pruned []*LocalImage
+
+	for _, l := range locals {
+		if referenced[l.Checksum] {
+			continue
+		}
+
+		if _, err := r.Remove(ctx, l.Checksum); err != nil {
+			return pruned, err
+		}
+
+		pruned = append(pruned, l)
+	}
+
+	return pruned, nil
+}
+
+// FindLocal returns the stored image with a checksum or unique checksum prefix.
+func (r *ImageRepository) FindLocal(checksum string) (*LocalImage, error) {
+	locals, err := r.LocalImages()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var found *LocalImage
+
+	for _, l := range locals {
+		if !strings.HasPrefix(l.Checksum, checksum) {
+			continue
+		}
+
+		if found != nil {
+			return nil, fmt.Errorf("checksum prefix '%s' is ambiguous", checksum)
+		}
+
+		found = l
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("no stored image with checksum '%s'", checksum)
+	}
+
+	return found, nil
+}
+
+// ShortChecksum returns the abbreviated checksum of an image shown to users.
+// Checksums which are shorter already, such as from hand-written manifests, are returned as is.
+func ShortChecksum(checksum string) string {
+	if len(checksum) > 12 {
+		return checksum[:12]
+	}
+
+	return checksum
+}
@@ -0,0 +1,119 @@
+package fog
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPruneKeepsImagesLockedByOtherProjects(t *testing.T) {
+	dataDir := t.TempDir()
+
+	locked := sha256Hex("locked")
+	unused := sha256Hex("unused")
+
+	if err := os.MkdirAll(path.Join(dataDir, "images"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sum := range []string{locked, unused} {
+		if err := os.WriteFile(path.Join(dataDir, "images", sum+".qcow2"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	other := newTestRepository(t, RepositoryOptions{})
+	other.dataDir = dataDir
+	other.lockPath = path.Join(t.TempDir(), "fog.lock")
+
+	lock := &ImageLock{Images: map[string]*LockedImage{
+		lockKey("debian", "bookworm", "x86_64"): {Checksum: locked},
+	}}
+
+	if err := other.writeLock(lock); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestRepository(t, RepositoryOptions{})
+	r.dataDir = dataDir
+	r.lockPath = path.Join(t.TempDir(), "fog.lock")
+
+	pruned, err := r.Prune(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pruned) != 1 || pruned[0].Checksum != unused {
+		t.Fatalf("pruned %+v, want only the unused image", pruned)
+	}
+
+	// Removing the other project's lock file releases its images
+	if err := os.Remove(other.lockPath); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err = r.Prune(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pruned) != 1 || pruned[0].Checksum != locked {
+		t.Fatalf("pruned %+v, want the formerly locked image", pruned)
+	}
+}
+
+func TestShortChecksum(t *testing.T) {
+	tests := []struct {
+		checksum string
+		want     string
+	}{
+		{"50510f98abe1b20a548102a05a9be83153b0bf634fc502d5c8d1f508f6de1430", "50510f98abe1"},
+		{"50510f98abe1", "50510f98abe1"},
+		{"disk", "disk"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := ShortChecksum(tt.checksum); got != tt.want {
+			t.Errorf("ShortChecksum(%q) = %q, want %q", tt.checksum, got, tt.want)
+		}
+	}
+}
+
+func TestPruneKeepsRegistryImagesOfMachines(t *testing.T) {
+	r := newTestRepository(t, RepositoryOptions{})
+	r.lockPath = path.Join(t.TempDir(), "fog.lock")
+
+	used := sha256Hex("used")
+	unused := sha256Hex("unused")
+
+	for _, sum := range []string{used, unused} {
+		storeTestImage(t, r, sum)
+	}
+
+	img := &Image{
+		Name:     "registry.local/vm/debian",
+		Tags:     []string{"12"},
+		Arch:     "x86_64",
+		Url:      "oci://registry.local/vm/debian@sha256:" + used,
+		Checksum: used,
+	}
+
+	// Registry images have no manifest, only their record in the lock file
+	if err := r.lockOci(context.Background(), img); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := r.Prune(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pruned) != 1 || pruned[0].Checksum != unused {
+		t.Fatalf("pruned %+v, want only the unused image", pruned)
+	}
+}
@@ -0,0 +1,464 @@
+package fog
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Upstream describes vendor published metadata used to resolve the newest build of an image.
+type Upstream struct {
+	// Type is the metadata format, either "simplestreams" or "checksums"
+	Type string
+	// Url is the location of the simplestreams index or checksums file
+	Url string
+	// BaseUrl is prepended to simplestreams item paths, by default the index URL up to the streams directory
+	BaseUrl string `yaml:"base_url,omitempty" mapstructure:"base_url"`
+	// Product is the simplestreams product name
+	Product string `yaml:",omitempty"`
+	// Item is the simplestreams item name, "disk1.img" by default
+	Item string `yaml:",omitempty"`
+	// Pattern is a regular expression matching image file names in a checksums file
+	Pattern string `yaml:",omitempty"`
+}
+
+// ImageLock records the resolved builds of images with upstream metadata, and
+// the builds of registry images used by the project's machines.
+type ImageLock struct {
+	// Images maps image names and tags to resolved builds
+	Images map[string]*LockedImage
+}
+
+// LockedImage is a resolved image build.
+type LockedImage struct {
+	Url      string
+	Checksum string
+}
+
+// resolved is a single build found in upstream metadata.
+type resolved struct {
+	version  string
+	url      string
+	checksum string
+}
+
+// resolveUpstream finds the newest build of an image from its upstream metadata.
+func resolveUpstream(ctx context.Context, client *http.Client, u *Upstream) (*LockedImage, error) {
+	var builds []resolved
+	var err error
+
+	switch u.Type {
+	case "simplestreams":
+		builds, err = resolveSimplestreams(ctx, client, u)
+	case "checksums":
+		builds, err = resolveChecksums(ctx, client, u)
+	default:
+		return nil, fmt.Errorf("unknown upstream type '%s'", u.Type)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(builds) == 0 {
+		return nil, fmt.Errorf("no builds found in %s", u.Url)
+	}
+
+	newest := builds[0]
+
+	for _, b := range builds[1:] {
+		if compareVersions(b.version, newest.version) > 0 {
+			newest = b
+		}
+	}
+
+	return &LockedImage{Url: newest.url, Checksum: newest.checksum}, nil
+}
+
+// simplestreamsIndex is the subset of the simplestreams products format used by fog.
+type simplestreamsIndex struct {
+	Products map[string]struct {
+		Versions map[string]struct {
+			Items map[string]struct {
+				Path   string `json:"path"`
+				Sha256 string `json:"sha256"`
+			} `json:"items"`
+		} `json:"versions"`
+	} `json:"products"`
+}
+
+func resolveSimplestreams(ctx context.Context, client *http.Client, u *Upstream) ([]resolved, error) {
+	buf, err := fetch(ctx, client, u.Url)
+
+	if err != nil {
+		return nil, fmt.Errorf("downloading simplestreams index: %w", err)
+	}
+
+	idx := simplestreamsIndex{}
+
+	if err := json.Unmarshal(buf, &idx); err != nil {
+		return nil, fmt.Errorf("parsing simplestreams index: %w", err)
+	}
+
+	prod, ok := idx.Products[u.Product]
+
+	if !ok {
+		return nil, fmt.Errorf("product '%s' not found in simplestreams index", u.Product)
+	}
+
+	item := u.Item
+
+	if item == "" {
+		item = "disk1.img"
+	}
+
+	baseUrl := u.BaseUrl
+
+	if baseUrl == "" {
+		i := strings.Index(u.Url, "streams/")
+
+		if i < 0 {
+			return nil, errors.New("simplestreams base URL can not be derived from the index URL")
+		}
+
+		baseUrl = u.Url[:i]
+	}
+
+	if !strings.HasSuffix(baseUrl, "/") {
+		baseUrl += "/"
+	}
+
+	var builds []resolved
+
+	for v, ver := range prod.Versions {
+		it, ok := ver.Items[item]
+
+		if !ok || it.Sha256 == "" {
+			continue
+		}
+
+		builds = append(builds, resolved{
+			version:  v,
+			url:      baseUrl + it.Path,
+			checksum: it.Sha256,
+		})
+	}
+
+	return builds, nil
+}
+
+var (
+	// bsdChecksumLine matches lines such as "SHA256 (file.qcow2) = abc..."
+	bsdChecksumLine = regexp.MustCompile(`^SHA256 \((.+)\) = ([0-9a-fA-F]{64})$`)
+	// gnuChecksumLine matches lines such as "abc... *file.img"
+	gnuChecksumLine = regexp.MustCompile(`^([0-9a-fA-F]{64}) [ *](.+)$`)
+)
+
+// parseChecksums parses a SHA256SUMS or CHECKSUM file into a map of file names to checksums.
+//
+// Lines in other formats, such as PGP armor in signed files, are ignored.
+func parseChecksums(buf []byte) map[string]string {
+	sums := make(map[string]string)
+
+	s := bufio.NewScanner(strings.NewReader(string(buf)))
+
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+
+		if m := bsdChecksumLine.FindStringSubmatch(line); m != nil {
+			sums[m[1]] = strings.ToLower(m[2])
+		} else if m := gnuChecksumLine.FindStringSubmatch(line); m != nil {
+			sums[m[2]] = strings.ToLower(m[1])
+		}
+	}
+
+	return sums
+}
+
+func resolveChecksums(ctx context.Context, client *http.Client, u *Upstream) ([]resolved, error) {
+	pattern, err := regexp.Compile("^(?:" + u.Pattern + ")$")
+
+	if err != nil {
+		return nil, fmt.Errorf("parsing upstream pattern: %w", err)
+	}
+
+	base, err := url.Parse(u.Url)
+
+	if err != nil {
+		return nil, fmt.Errorf("parsing upstream URL: %w", err)
+	}
+
+	buf, err := fetch(ctx, client, u.Url)
+
+	if err != nil {
+		return nil, fmt.Errorf("downloading checksums: %w", err)
+	}
+
+	var builds []resolved
+
+	for name, sum := range parseChecksums(buf) {
+		if !pattern.MatchString(name) {
+			continue
+		}
+
+		ref, err := url.Parse(name)
+
+		if err != nil {
+			continue
+		}
+
+		builds = append(builds, resolved{
+			version:  name,
+			url:      base.ResolveReference(ref).String(),
+			checksum: sum,
+		})
+	}
+
+	return builds, nil
+}
+
+// compareVersions compares two version strings, treating runs of digits as numbers.
+func compareVersions(a, b string) int {
+	for a != "" && b != "" {
+		ca, ra := versionChunk(a)
+		cb, rb := versionChunk(b)
+
+		na, errA := strconv.ParseUint(ca, 10, 64)
+		nb, errB := strconv.ParseUint(cb, 10, 64)
+
+		switch {
+		case errA == nil && errB == nil && na != nb:
+			if na < nb {
+				return -1
+			}
+
+			return 1
+		case (errA != nil || errB != nil) && ca != cb:
+			return strings.Compare(ca, cb)
+		}
+
+		a, b = ra, rb
+	}
+
+	return strings.Compare(a, b)
+}
+
+// versionChunk splits the leading run of digits or non-digits from a version string.
+func versionChunk(s string) (string, string) {
+	digit := s[0] >= '0' && s[0] <= '9'
+
+	i := 1
+
+	for i < len(s) && (s[i] >= '0' && s[i] <= '9') == digit {
+		i++
+	}
+
+	return s[:i], s[i:]
+}
+
+// lockKey returns the key for an image in the lock file.
+// The architecture is included so builds of different architectures don't collide.
+func lockKey(name, tag, arch string) string {
+	if arch == "" {
+		return name + ":" + tag
+	}
+
+	return name + ":" + tag + "@" + normalizeArch(arch)
+}
+
+// readLock reads the image lock file.
+// Expects the lock mutex to be held already when called.
+func (r *ImageRepository) readLock() (*ImageLock, error) {
+	lock := &ImageLock{}
+
+	buf, err := os.ReadFile(r.lockPath)
+
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("reading image lock file: %w", err)
+	}
+
+	if err == nil {
+		if err := yaml.Unmarshal(buf, lock); err != nil {
+			return nil, fmt.Errorf("parsing image lock file: %w", err)
+		}
+
+		// A lock file checked out with a project is registered when it is first read
+		if err := r.registerLock(); err != nil {
+			return nil, err
+		}
+	}
+
+	if lock.Images == nil {
+		lock.Images = make(map[string]*LockedImage)
+	}
+
+	return lock, nil
+}
+
+// writeLock writes the image lock file.
+// It is replaced atomically, so it can be read without holding the lock.
+// Expects the lock mutex and the file lock of lockUpdates to be held already when called.
+func (r *ImageRepository) writeLock(lock *ImageLock) error {
+	buf, err := yaml.Marshal(lock)
+
+	if err != nil {
+		return fmt.Errorf("encoding image lock file: %w", err)
+	}
+
+	if err := os.MkdirAll(path.Dir(r.lockPath), os.ModePerm); err != nil {
+		return fmt.Errorf("creating image lock file directory: %w", err)
+	}
+
+	tmpPath := r.lockPath + ".tmp"
+
+	if err := os.WriteFile(tmpPath, buf, 0644); err != nil {
+		return fmt.Errorf("writing image lock file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, r.lockPath); err != nil {
+		return fmt.Errorf("writing image lock file: %w", err)
+	}
+
+	return r.registerLock()
+}
+
+// registerLock records the path of the image lock file in the data directory,
+// so images pinned by any project are kept when pruning.
+func (r *ImageRepository) registerLock() error {
+	h := sha256.Sum256([]byte(r.lockPath))
+	p := path.Join(r.dataDir, "lockfiles", hex.EncodeToString(h[:8]))
+
+	if _, err := os.Stat(p); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(path.Dir(p), os.ModePerm); err != nil {
+		return fmt.Errorf("creating lock file registry: %w", err)
+	}
+
+	if err := os.WriteFile(p, []byte(r.lockPath), 0644); err != nil {
+		return fmt.Errorf("registering image lock file: %w", err)
+	}
+
+	return nil
+}
+
+// lockedChecksums returns the checksums of the images pinned by the lock files
+// of all projects. Lock files which no longer exist are unregistered.
+func (r *ImageRepository) lockedChecksums() (map[string]bool, error) {
+	dir := path.Join(r.dataDir, "lockfiles")
+
+	entries, err := os.ReadDir(dir)
+
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("reading lock file registry: %w", err)
+	}
+
+	sums := make(map[string]bool)
+
+	for _, e := range entries {
+		p, err := os.ReadFile(path.Join(dir, e.Name()))
+
+		if err != nil {
+			return nil, fmt.Errorf("reading lock file registry: %w", err)
+		}
+
+		buf, err := os.ReadFile(string(p))
+
+		if errors.Is(err, fs.ErrNotExist) {
+			os.Remove(path.Join(dir, e.Name()))
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("reading image lock file: %w", err)
+		}
+
+		lock := &ImageLock{}
+
+		if err := yaml.Unmarshal(buf, lock); err != nil {
+			return nil, fmt.Errorf("parsing image lock file %s: %w", p, err)
+		}
+
+		for _, locked := range lock.Images {
+			sums[locked.Checksum] = true
+		}
+	}
+
+	return sums, nil
+}
+
+// lockUpdates takes the file lock guarding updates of the image lock file, so
+// fog processes sharing the lock file don't lose each other's updates.
+func (r *ImageRepository) lockUpdates(ctx context.Context) (func() error, error) {
+	h := sha256.Sum256([]byte(r.lockPath))
+
+	unlock, err := lockFile(ctx, path.Join(r.dataDir, "locks", "lockfile-"+hex.EncodeToString(h[:8])+".lock"))
+
+	if err != nil {
+		return nil, fmt.Errorf("locking image lock file: %w", err)
+	}
+
+	return unlock, nil
+}
+
+// resolve returns a copy of an image with the URL and checksum of the newest upstream build.
+//
+// Resolved builds are recorded in the lock file and reused by later calls unless
+// refresh is set.
+func (r *ImageRepository) resolve(ctx context.Context, img *Image, tag string, refresh bool) (*Image, error) {
+	r.lockMu.Lock()
+	defer r.lockMu.Unlock()
+
+	unlock, err := r.lockUpdates(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer unlock()
+
+	lock, err := r.readLock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	key := lockKey(img.Name, tag, img.Arch)
+
+	locked, ok := lock.Images[key]
+
+	if !ok || refresh {
+		locked, err = resolveUpstream(ctx, r.client, img.Upstream)
+
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s: %w", key, err)
+		}
+
+		lock.Images[key] = locked
+
+		if err := r.writeLock(lock); err != nil {
+			return nil, err
+		}
+	}
+
+	res := *img
+	res.Url = locked.Url
+	res.Checksum = locked.Checksum
+
+	return &res, nil
+}
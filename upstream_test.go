@@ -0,0 +1,133 @@
+package fog
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sync"
+	"testing"
+)
+
+func TestResolveConcurrentProcesses(t *testing.T) {
+	sum := sha256Hex("image")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s *image-1.qcow2\n", sum)
+	}))
+
+	defer srv.Close()
+
+	dir := t.TempDir()
+
+	img := &Image{
+		Name: "test",
+		Arch: "x86_64",
+		Upstream: &Upstream{
+			Type:    "checksums",
+			Url:     srv.URL + "/SHA256SUMS",
+			Pattern: `image-\d+\.qcow2`,
+		},
+	}
+
+	// Repositories have their own mutex, like separate fog processes
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		r := newTestRepository(t, RepositoryOptions{})
+		r.dataDir = path.Join(dir, "data")
+		r.lockPath = path.Join(dir, "project", "fog.lock")
+
+		tag := fmt.Sprintf("tag%d", i)
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if _, err := r.resolve(context.Background(), img, tag, false); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	r := newTestRepository(t, RepositoryOptions{})
+	r.lockPath = path.Join(dir, "project", "fog.lock")
+
+	lock, err := r.readLock()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(lock.Images) != 8 {
+		t.Fatalf("got %d locked images, want 8", len(lock.Images))
+	}
+}
+
+func TestResolveIgnoresLockKeyWithoutArch(t *testing.T) {
+	sums := map[string]string{
+		"x86_64":  sha256Hex("x86_64"),
+		"aarch64": sha256Hex("aarch64"),
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arch := path.Base(path.Dir(r.URL.Path))
+
+		fmt.Fprintf(w, "%s *image-%s.qcow2\n", sums[arch], arch)
+	}))
+
+	defer srv.Close()
+
+	r := newTestRepository(t, RepositoryOptions{})
+
+	// An entry without an architecture must not be taken for either build
+	lock := &ImageLock{Images: map[string]*LockedImage{
+		"test:bookworm": {Url: srv.URL + "/image.qcow2", Checksum: sums["x86_64"]},
+	}}
+
+	if err := r.writeLock(lock); err != nil {
+		t.Fatal(err)
+	}
+
+	for arch := range sums {
+		r.projectImgs = append(r.projectImgs, &Image{
+			Name:     "test",
+			Tags:     []string{"bookworm"},
+			Arch:     arch,
+			Upstream: &Upstream{Type: "checksums", Url: srv.URL + "/" + arch + "/SHA256SUMS", Pattern: `image-\w+\.qcow2`},
+		})
+	}
+
+	if err := r.LoadManifests(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The other architecture is resolved first, while the entry is still there
+	for _, arch := range []string{"aarch64", "x86_64"} {
+		img, err := r.Find(context.Background(), "test:bookworm", arch)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if img.Checksum != sums[arch] {
+			t.Fatalf("got checksum %s for %s, want %s", img.Checksum, arch, sums[arch])
+		}
+	}
+
+	lock, err := r.readLock()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for arch, sum := range sums {
+		if locked := lock.Images[lockKey("test", "bookworm", arch)]; locked == nil || locked.Checksum != sum {
+			t.Fatalf("got locked %s build %+v, want %s", arch, locked, sum)
+		}
+	}
+}